@@ -4,7 +4,7 @@ CREATE TABLE IF NOT EXISTS users (
   id INTEGER PRIMARY KEY AUTOINCREMENT,
   username TEXT UNIQUE NOT NULL,
   display_name TEXT,
-  role TEXT NOT NULL CHECK (role IN ('player','coach','admin')),
+  role TEXT NOT NULL,
   password_hash TEXT NOT NULL,
   created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 );
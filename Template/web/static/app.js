@@ -2,11 +2,11 @@
 //  AUTH HANDLING
 // =======================================================
 document.addEventListener("DOMContentLoaded", () => {
-    const token = localStorage.getItem("token");
+    const token = csrfToken();
     const DEBUG_STOP_REDIRECT = false;
 
     if (!token && !window.location.pathname.endsWith("index.html")) {
-        console.warn("No token found — redirecting to login");
+        console.warn("No session found — redirecting to login");
         if (!DEBUG_STOP_REDIRECT) {
             window.location.href = "/index.html";
             return;
@@ -19,10 +19,17 @@ document.addEventListener("DOMContentLoaded", () => {
         }
     }
 
+    if (token) scheduleRefresh();
+
     const logoutBtn = document.getElementById("logoutBtn");
     if (logoutBtn) {
-        logoutBtn.addEventListener("click", () => {
-            localStorage.removeItem("token");
+        logoutBtn.addEventListener("click", async () => {
+            try {
+                await authFetch("/api/auth/logout", { method: "POST" });
+            } catch (err) {
+                console.warn("Logout request failed:", err);
+            }
+            clearSession();
             window.location.href = "/index.html";
         });
     }
@@ -35,22 +42,84 @@ document.addEventListener("DOMContentLoaded", () => {
 // =======================================================
 //  HELPER FUNCTIONS
 // =======================================================
-async function apiFetch(url, options = {}) {
-    options.headers = {
-        ...(options.headers || {}),
-        "Authorization": "Bearer " + localStorage.getItem("token"),
-        "Content-Type": "application/json",
-    };
+// The session lives in HttpOnly cookies the page can't read. The CSRF
+// cookie next to them is readable, and doubles as the "signed in" flag.
+function csrfToken() {
+    const match = document.cookie.match(/(?:^|; )vfe_csrf=([^;]*)/);
+    return match ? match[1] : "";
+}
 
-    const res = await fetch(url, options);
+function clearSession() {
+    document.cookie = "vfe_csrf=; Max-Age=0; path=/";
+    localStorage.removeItem("session_expires");
+}
+
+// Access tokens are short-lived; refreshing rotates the cookies.
+// Concurrent callers share one request so the token is only rotated once.
+let refreshing = null;
+function refreshSession() {
+    if (!refreshing) {
+        refreshing = (async () => {
+            const used = csrfToken();
+            if (!used) return false;
+            const res = await fetch("/api/auth/refresh", {
+                method: "POST",
+                headers: { "X-CSRF-Token": used },
+            });
+            if (!res.ok) {
+                // Another tab may have rotated it in the meantime.
+                return csrfToken() !== used;
+            }
+            const data = await res.json();
+            localStorage.setItem("session_expires", Date.now() + data.expires_in * 1000);
+            scheduleRefresh();
+            return true;
+        })().finally(() => { refreshing = null; });
+    }
+    return refreshing;
+}
+
+// Refresh a minute before the access cookie expires, so a video that is
+// playing keeps loading; the player can't retry a 401 itself.
+let refreshTimer = null;
+function scheduleRefresh() {
+    clearTimeout(refreshTimer);
+    const expires = Number(localStorage.getItem("session_expires") || 0);
+    refreshTimer = setTimeout(refreshSession, Math.max(0, expires - Date.now() - 60000));
+}
+
+// fetch with the session cookies, refreshing them once on a 401.
+async function authFetch(url, options = {}) {
+    const send = () => fetch(url, {
+        ...options,
+        headers: {
+            ...(options.headers || {}),
+            "X-CSRF-Token": csrfToken(),
+        },
+    });
+
+    let res = await send();
+    if (res.status === 401 && await refreshSession()) {
+        res = await send();
+    }
     if (res.status === 401) {
         console.warn("Unauthorized — redirecting to login...");
-        localStorage.removeItem("token");
+        clearSession();
         if (!window.location.pathname.endsWith("index.html")) {
             window.location.href = "/index.html";
         }
         throw new Error("unauthorized");
     }
+    return res;
+}
+
+async function apiFetch(url, options = {}) {
+    options.headers = {
+        ...(options.headers || {}),
+        "Content-Type": "application/json",
+    };
+
+    const res = await authFetch(url, options);
 
     if (!res.ok) throw new Error("Request failed: " + res.status);
     return res.json();
@@ -69,19 +138,15 @@ async function loadDashboard() {
     container.innerHTML = "<p>Loading VODs...</p>";
     navBar.innerHTML = ""; // clear back button area
 
-    const token = localStorage.getItem("token");
-    if (!token) {
-        console.warn("No token found, redirecting...");
+    if (!csrfToken()) {
+        console.warn("No session found, redirecting...");
         window.location.href = "/index.html";
         return;
     }
 
     let vods;
     try {
-        const res = await fetch("/api/list-vods", {
-            headers: { "Authorization": "Bearer " + token },
-        });
-        vods = await res.json();
+        vods = await fetchAllVods();
     } catch (err) {
         console.error("Failed to load VODs:", err);
         container.innerHTML = "<p>Error loading VODs</p>";
@@ -97,16 +162,8 @@ async function loadDashboard() {
 
     const grouped = {};
     vods.forEach(vod => {
-        let team = vod.team_name || "Unknown Team";
-        let player = vod.player_name || "Unknown Player";
-
-        if (vod.file_path) {
-            const match = vod.file_path.match(/teams\\/([^/]+)\\/players\\/([^/]+)/i);
-            if (match) {
-                team = match[1];
-                player = match[2];
-            }
-        }
+        const team = vod.team_name || "Unknown Team";
+        const player = vod.player_name || "Unknown Player";
 
         if (!grouped[team]) grouped[team] = {};
         if (!grouped[team][player]) grouped[team][player] = [];
@@ -116,6 +173,18 @@ async function loadDashboard() {
     renderTeams(container, grouped, vods.length);
 }
 
+// Follows the listing's cursor until every VOD the user can see is loaded.
+async function fetchAllVods() {
+    const vods = [];
+    let cursor = "";
+    do {
+        const page = await apiFetch("/api/list-vods?limit=500" + (cursor ? "&cursor=" + encodeURIComponent(cursor) : ""));
+        vods.push(...(page.vods || []));
+        cursor = page.next_cursor;
+    } while (cursor);
+    return vods;
+}
+
 function renderTeams(container, grouped, count) {
     container.innerHTML = "<h2>Teams</h2>";
     const navBar = document.getElementById("nav-bar");
@@ -201,23 +270,22 @@ function openPlayer(teamName, playerName, vods, grouped) {
         const card = document.createElement("div");
         card.className = "vod-card";
 
-        const video = document.createElement("video");
-        video.src = "/vods/" + vod.file_path.replace(/^storage[\\/]/, "");
-        video.controls = false;
-        video.muted = true;
-        video.loop = true;
-        video.width = 220;
-        video.height = 120;
-        video.addEventListener("mouseenter", () => video.play());
-        video.addEventListener("mouseleave", () => {
-            video.pause();
-            video.currentTime = 0;
-        });
+        const thumb = createVodThumb(vod);
 
         const vt = document.createElement("p");
         vt.textContent = vod.title || vod.file_name || "Untitled";
 
-        card.appendChild(video);
+        // Archived VODs keep their notes but the video itself is offline
+        // until an admin restores it.
+        if (vod.archived) {
+            card.classList.add("archived");
+            const badge = document.createElement("span");
+            badge.className = "archived-badge";
+            badge.textContent = "Archived";
+            thumb.appendChild(badge);
+        }
+
+        card.appendChild(thumb);
         card.appendChild(vt);
         card.addEventListener("click", () => openTheaterWithNotes(vod));
         grid.appendChild(card);
@@ -226,6 +294,72 @@ function openPlayer(teamName, playerName, vods, grouped) {
     container.appendChild(grid);
 }
 
+// =======================================================
+//  VOD PREVIEWS (poster + sprite-sheet scrubbing)
+// =======================================================
+function createVodThumb(vod) {
+    const base = "/derived/vods/" + vod.id + "/";
+
+    const thumb = document.createElement("div");
+    thumb.className = "vod-thumb";
+
+    const img = document.createElement("img");
+    img.src = base + "poster.jpg";
+    img.alt = "";
+    img.loading = "lazy";
+    img.addEventListener("error", () => img.remove());
+
+    const scrub = document.createElement("div");
+    scrub.className = "scrub-preview";
+
+    thumb.appendChild(img);
+    thumb.appendChild(scrub);
+
+    let cues = null;
+    thumb.addEventListener("mouseenter", async () => {
+        if (cues !== null) return;
+        cues = [];
+        try {
+            const res = await fetch(base + "sprite.vtt");
+            if (res.ok) cues = parseSpriteVTT(await res.text(), base);
+        } catch (err) {
+            console.warn("Could not load scrub preview:", err);
+        }
+    });
+    thumb.addEventListener("mousemove", e => {
+        if (!cues || cues.length === 0) return;
+        const rect = thumb.getBoundingClientRect();
+        const frac = Math.min(Math.max((e.clientX - rect.left) / rect.width, 0), 0.999);
+        const cue = cues[Math.floor(frac * cues.length)];
+        const scale = rect.width / cue.w;
+        scrub.style.backgroundImage = "url(" + cue.url + ")";
+        scrub.style.backgroundSize = (cues.sheetW * scale) + "px " + (cues.sheetH * scale) + "px";
+        scrub.style.backgroundPosition = (-cue.x * scale) + "px " + (-cue.y * scale) + "px";
+        scrub.style.display = "block";
+    });
+    thumb.addEventListener("mouseleave", () => {
+        scrub.style.display = "none";
+    });
+
+    return thumb;
+}
+
+// Parses the sprite.vtt index into [{url, x, y, w, h}] with the sheet size attached.
+function parseSpriteVTT(text, base) {
+    const cues = [];
+    cues.sheetW = 0;
+    cues.sheetH = 0;
+    text.split("\n").forEach(line => {
+        const m = line.trim().match(/^(.+)#xywh=(\d+),(\d+),(\d+),(\d+)$/);
+        if (!m) return;
+        const cue = { url: base + m[1], x: +m[2], y: +m[3], w: +m[4], h: +m[5] };
+        cues.sheetW = Math.max(cues.sheetW, cue.x + cue.w);
+        cues.sheetH = Math.max(cues.sheetH, cue.y + cue.h);
+        cues.push(cue);
+    });
+    return cues;
+}
+
 // =======================================================
 //  THEATER MODE (Fullscreen Video + Notes)
 // =======================================================
@@ -299,6 +433,11 @@ async function openTheaterWithNotes(vod) {
 
     notes.forEach(n => renderNote(noteList, n, vod, video));
 
+    // === Match notes, shared by every POV of the match ===
+    if (vod.match_id) {
+        loadMatchNotes(vod, notePanel, video);
+    }
+
     // === Add Note Button ===
     addBtn.addEventListener("click", async () => {
         const timestamp = formatTimestamp(video.currentTime);
@@ -315,6 +454,102 @@ async function openTheaterWithNotes(vod) {
     });
 }
 
+// Match notes belong to the match rather than this VOD, so they get their
+// own list and are saved one at a time instead of with the VOD's notes.
+// They are stamped in match time; this VOD's offset from the timeline
+// converts between that and the video's own time.
+async function loadMatchNotes(vod, notePanel, video) {
+    const base = "/api/matches/" + vod.match_id + "/notes";
+    let offset = 0;
+
+    const header = document.createElement("div");
+    header.className = "note-header match-note-header";
+    header.innerHTML = "<h3>Match notes</h3>";
+
+    const addBtn = document.createElement("button");
+    addBtn.textContent = "+ Match Note";
+    addBtn.className = "add-note-btn";
+    header.appendChild(addBtn);
+
+    const list = document.createElement("div");
+    list.className = "note-list match-note-list";
+    notePanel.appendChild(header);
+    notePanel.appendChild(list);
+
+    const refresh = async () => {
+        let res;
+        try {
+            res = await apiFetch("/api/matches/" + vod.match_id + "/timeline");
+        } catch (err) {
+            console.warn("Failed to load match notes:", err);
+            return;
+        }
+        const pov = (res.povs || []).find(p => p.vod_id === vod.id);
+        offset = pov ? pov.offset : 0;
+        list.innerHTML = "";
+        (res.notes || []).forEach(n => renderMatchNote(list, n, base, video, n.ts_seconds - offset));
+    };
+
+    addBtn.addEventListener("click", async () => {
+        const ts = Math.floor(video.currentTime);
+        const text = prompt("Match note at " + formatTimestamp(ts) + ":");
+        if (!text || !text.trim()) return;
+        try {
+            await apiFetch(base, {
+                method: "POST",
+                body: JSON.stringify({ ts_seconds: ts + offset, content: text }),
+            });
+        } catch (err) {
+            console.warn("Could not add match note:", err);
+            return;
+        }
+        await refresh();
+    });
+
+    await refresh();
+}
+
+// position is where the note falls in this VOD; it may be outside the
+// recording when this POV started late or stopped early.
+function renderMatchNote(container, note, base, video, position) {
+    const card = document.createElement("div");
+    card.className = "note-card match-note-card";
+
+    const header = document.createElement("div");
+    header.className = "note-card-header";
+    const inRange = position >= 0 && !(video.duration && position > video.duration);
+    header.textContent = (inRange ? formatTimestamp(position) : "--:--") + " · " + note.author;
+    if (inRange) {
+        header.style.cursor = "pointer";
+        header.addEventListener("click", () => {
+            video.currentTime = position;
+        });
+    }
+
+    const delBtn = document.createElement("button");
+    delBtn.textContent = "✖";
+    delBtn.className = "note-del-btn";
+    delBtn.addEventListener("click", async (e) => {
+        e.stopPropagation();
+        if (!confirm("Delete this match note?")) return;
+        const res = await authFetch(base + "/" + note.id, { method: "DELETE" });
+        if (res.ok) {
+            card.remove();
+        } else {
+            alert(await res.text());
+        }
+    });
+    header.appendChild(delBtn);
+
+    const text = document.createElement("p");
+    text.className = "match-note-text";
+    text.textContent = note.content;
+
+    card.appendChild(header);
+    card.appendChild(text);
+    container.appendChild(card);
+}
+
 // Helper: render note card
 function renderNote(container, note, vod, video) {
     const noteCard = document.createElement("div");
@@ -370,10 +605,7 @@ function parseTimestampToSeconds(t) {
 
 async function deleteNotes(vod) {
     try {
-        await fetch("/api/notes?vod_id=" + vod.id, {
-            method: "DELETE",
-            headers: { "Authorization": "Bearer " + localStorage.getItem("token") },
-        });
+        await authFetch("/api/notes?vod_id=" + vod.id, { method: "DELETE" });
         localStorage.removeItem("notes_" + vod.file_path);
     } catch (err) {
         console.warn("Could not delete notes:", err);
@@ -392,12 +624,9 @@ async function saveNotes(vod, container) {
 
     // Send to backend for permanent storage
     try {
-        const res = await fetch("/api/notes", {
+        const res = await authFetch("/api/notes", {
             method: "POST",
-            headers: {
-                "Content-Type": "application/json",
-                "Authorization": "Bearer " + localStorage.getItem("token"),
-            },
+            headers: { "Content-Type": "application/json" },
             body: JSON.stringify({
                 vod_id: vod.id,
                 notes: notes,
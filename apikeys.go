@@ -0,0 +1,259 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------------------- API KEYS -----------------------
+
+const (
+	apiKeyPrefix         = "vfe_"
+	defaultAPIKeyDays    = 365
+	maxAPIKeyDays        = 5 * 365
+	apiKeyLastUsedWindow = time.Minute
+)
+
+var apiKeyScopes = []string{"vods:read", "vods:upload", "notes:read", "notes:write"}
+
+// apiKeyScope is the scope a request needs when made with an API key. Empty
+// means API keys can't use the endpoint at all.
+func apiKeyScope(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, "/vods/") || strings.HasPrefix(r.URL.Path, "/derived/") ||
+		strings.HasPrefix(r.URL.Path, "/api/players/") {
+		return "vods:read"
+	}
+	// Keys only read VOD metadata; editing it stays with signed-in users.
+	if strings.HasPrefix(r.URL.Path, "/api/vods/") && r.URL.Path != "/api/vods/upload" {
+		if r.Method == http.MethodGet {
+			return "vods:read"
+		}
+		return ""
+	}
+	if r.URL.Path == "/api/matches" || strings.HasPrefix(r.URL.Path, "/api/matches/") {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/matches"), "/"), "/")
+		notes := len(parts) >= 2 && parts[1] == "notes"
+		switch {
+		case r.Method != http.MethodGet:
+			// Of the match changes, keys may only add and delete notes.
+			if notes {
+				return "notes:write"
+			}
+			return ""
+		case notes || strings.HasSuffix(r.URL.Path, "/timeline"):
+			return "notes:read"
+		}
+		return "vods:read"
+	}
+	switch r.URL.Path {
+	case "/api/list-vods", "/api/teams", "/api/players", "/api/me", "/api/me/vods":
+		return "vods:read"
+	case "/api/vods/upload":
+		return "vods:upload"
+	case "/api/notes/add":
+		return "notes:write"
+	case "/api/notes":
+		if r.Method == http.MethodGet {
+			return "notes:read"
+		}
+		return "notes:write"
+	}
+	return ""
+}
+
+// apiKeyUser resolves a key to the user it acts as and its scopes, and
+// records when it was last used.
+func (s *Server) apiKeyUser(r *http.Request, key string) (keyID int64, u sessionUser, scopes []string, err error) {
+	var scopeList string
+	now := time.Now()
+	err = s.db.QueryRow(`SELECT k.id, k.scopes, u.id, u.username, u.role
+		FROM api_keys k JOIN users u ON u.id = k.user_id
+		WHERE k.key_hash = ? AND k.revoked_at IS NULL AND k.expires_at > ? AND u.disabled_at IS NULL`,
+		hashSecret(key), now.Unix()).Scan(&keyID, &scopeList, &u.ID, &u.Username, &u.Role)
+	if err != nil {
+		return
+	}
+	s.db.Exec(`UPDATE api_keys SET last_used_at = ?, last_used_ip = ?
+		WHERE id = ? AND COALESCE(last_used_at, 0) < ?`,
+		now.Unix(), clientIP(r), keyID, now.Add(-apiKeyLastUsedWindow).Unix())
+	return keyID, u, strings.Fields(scopeList), nil
+}
+
+type APIKey struct {
+	ID         int64    `json:"id"`
+	Name       string   `json:"name"`
+	Prefix     string   `json:"prefix"`
+	Scopes     []string `json:"scopes"`
+	User       string   `json:"user"`
+	CreatedAt  string   `json:"created_at"`
+	ExpiresAt  string   `json:"expires_at"`
+	LastUsedAt string   `json:"last_used_at,omitempty"`
+	LastUsedIP string   `json:"last_used_ip,omitempty"`
+	Revoked    bool     `json:"revoked"`
+}
+
+// apiKeys serves /api/admin/api-keys (GET list, POST create) and
+// /api/admin/api-keys/{id} (DELETE revokes).
+func (s *Server) apiKeys(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/api-keys"), "/")
+	if rest == "" {
+		switch r.Method {
+		case http.MethodGet:
+			s.listAPIKeys(w, r)
+		case http.MethodPost:
+			s.createAPIKey(w, r)
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+		return
+	}
+
+	id, err := strconv.ParseInt(rest, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	res, err := s.db.Exec(`UPDATE api_keys SET revoked_at = COALESCE(revoked_at, CURRENT_TIMESTAMP) WHERE id = ?`, id)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "API key not found", 404)
+		return
+	}
+	s.audit(r, "api_key.revoke", "api_key", id, nil, nil)
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
+
+// listAPIKeys shows live keys; ?all=true includes expired and revoked ones.
+func (s *Server) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	limit, offset := pageParams(r, 50, 500)
+	query := `SELECT k.id, k.name, k.prefix, k.scopes, COALESCE(u.username, ''), COALESCE(k.created_at, ''),
+		k.expires_at, COALESCE(k.last_used_at, 0), COALESCE(k.last_used_ip, ''), k.revoked_at IS NOT NULL
+		FROM api_keys k LEFT JOIN users u ON u.id = k.user_id WHERE 1=1`
+	var args []any
+	if r.URL.Query().Get("all") != "true" {
+		query += ` AND k.revoked_at IS NULL AND k.expires_at > ?`
+		args = append(args, time.Now().Unix())
+	}
+	query += ` ORDER BY k.id DESC LIMIT ? OFFSET ?`
+	args = append(args, limit, offset)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer rows.Close()
+	keys := []APIKey{}
+	for rows.Next() {
+		var k APIKey
+		var scopes string
+		var expires, lastUsed int64
+		if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &scopes, &k.User, &k.CreatedAt,
+			&expires, &lastUsed, &k.LastUsedIP, &k.Revoked); err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		k.Scopes = strings.Fields(scopes)
+		k.ExpiresAt = time.Unix(expires, 0).UTC().Format(time.DateTime)
+		if lastUsed > 0 {
+			k.LastUsedAt = time.Unix(lastUsed, 0).UTC().Format(time.DateTime)
+		}
+		keys = append(keys, k)
+	}
+	writeJSON(w, 200, map[string]any{"api_keys": keys, "limit": limit, "offset": offset})
+}
+
+// createAPIKey takes {name, scopes, user_id, expires_days}. The key acts as
+// user_id (default: whoever creates it), limited to its scopes. The key
+// itself is only shown here.
+func (s *Server) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name        string   `json:"name"`
+		Scopes      []string `json:"scopes"`
+		UserID      int64    `json:"user_id"`
+		ExpiresDays int      `json:"expires_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" {
+		http.Error(w, "missing name", 400)
+		return
+	}
+	if len(body.Scopes) == 0 {
+		http.Error(w, "at least one scope is required", 400)
+		return
+	}
+	for _, sc := range body.Scopes {
+		if !slices.Contains(apiKeyScopes, sc) {
+			http.Error(w, fmt.Sprintf("unknown scope %q (valid: %s)", sc, strings.Join(apiKeyScopes, ", ")), 400)
+			return
+		}
+	}
+	slices.Sort(body.Scopes)
+	body.Scopes = slices.Compact(body.Scopes)
+	if body.ExpiresDays == 0 {
+		body.ExpiresDays = defaultAPIKeyDays
+	}
+	if body.ExpiresDays < 0 || body.ExpiresDays > maxAPIKeyDays {
+		http.Error(w, fmt.Sprintf("expires_days must be between 1 and %d", maxAPIKeyDays), 400)
+		return
+	}
+	creatorID, _ := userFrom(r.Context())
+	if body.UserID == 0 {
+		body.UserID = creatorID
+	}
+	var username, role string
+	err := s.db.QueryRow(`SELECT username, role FROM users WHERE id = ? AND disabled_at IS NULL`, body.UserID).Scan(&username, &role)
+	if err == sql.ErrNoRows {
+		http.Error(w, "user not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if !s.canGrant(r.Context(), role) {
+		http.Error(w, "you can't create keys for that user", 403)
+		return
+	}
+
+	key := apiKeyPrefix + newSecret()
+	prefix := key[:len(apiKeyPrefix)+6]
+	expires := time.Now().Add(time.Duration(body.ExpiresDays) * 24 * time.Hour)
+	res, err := s.db.Exec(`INSERT INTO api_keys (name, prefix, key_hash, user_id, scopes, created_by, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, body.Name, prefix, hashSecret(key), body.UserID,
+		strings.Join(body.Scopes, " "), creatorID, expires.Unix())
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	id, _ := res.LastInsertId()
+	fmt.Printf("🔑 API key %q created for %s\n", body.Name, username)
+	s.audit(r, "api_key.create", "api_key", id, nil, map[string]any{
+		"name": body.Name, "prefix": prefix, "user": username, "scopes": body.Scopes,
+	})
+	writeJSON(w, 201, map[string]any{
+		"id":         id,
+		"name":       body.Name,
+		"key":        key,
+		"prefix":     prefix,
+		"scopes":     body.Scopes,
+		"user":       username,
+		"expires_at": expires.UTC().Format(time.DateTime),
+	})
+}
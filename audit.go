@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------------------- AUDIT LOG -----------------------
+
+// Every change made through the API, and every VOD the server removes by
+// itself, is recorded in audit_events. Triggers refuse UPDATE and DELETE on
+// the table, so entries can only be added. The actor's username is copied
+// into each entry so it survives the account being deleted.
+
+type auditEvent struct {
+	ID         int64           `json:"id"`
+	CreatedAt  string          `json:"created_at"`
+	ActorID    int64           `json:"actor_id,omitempty"`
+	Actor      string          `json:"actor"`
+	APIKeyID   int64           `json:"api_key_id,omitempty"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type"`
+	TargetID   string          `json:"target_id,omitempty"`
+	IP         string          `json:"ip,omitempty"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+}
+
+// audit records an action by the request's user. before and after are
+// short summaries of the target, stored as JSON; either may be nil.
+// Failing to write the entry is logged but doesn't fail the request, which
+// has already happened by the time this is called.
+func (s *Server) audit(r *http.Request, action, targetType string, targetID any, before, after any) {
+	var u userInfo
+	if v, ok := r.Context().Value(userCtxKey{}).(userInfo); ok {
+		u = v
+	}
+	s.writeAudit(u.ID, s.actorName(u.ID), u.APIKeyID, clientIP(r), action, targetType, targetID, before, after)
+}
+
+// auditAs is audit for requests that aren't signed in but act as a known
+// user, such as accepting an invite or using a password reset link.
+func (s *Server) auditAs(r *http.Request, userID int64, action, targetType string, targetID any, before, after any) {
+	s.writeAudit(userID, s.actorName(userID), 0, clientIP(r), action, targetType, targetID, before, after)
+}
+
+func (s *Server) actorName(userID int64) string {
+	var name string
+	if userID != 0 {
+		s.db.QueryRow(`SELECT username FROM users WHERE id = ?`, userID).Scan(&name)
+	}
+	return name
+}
+
+// auditSystem records something the server did on its own, like a scan
+// dropping a VOD whose file is gone.
+func (s *Server) auditSystem(action, targetType string, targetID any, before, after any) {
+	s.writeAudit(0, "system", 0, "", action, targetType, targetID, before, after)
+}
+
+func (s *Server) writeAudit(actorID int64, actor string, apiKeyID int64, ip, action, targetType string, targetID any, before, after any) {
+	summary := func(v any) any {
+		if v == nil {
+			return nil
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil
+		}
+		return string(b)
+	}
+	target := ""
+	if targetID != nil {
+		target = fmt.Sprint(targetID)
+	}
+	_, err := s.db.Exec(`INSERT INTO audit_events (actor_id, actor, api_key_id, action, target_type, target_id, ip, before, after)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		nullInt(actorID), actor, nullInt(apiKeyID), action, targetType, target, ip, summary(before), summary(after))
+	if err != nil {
+		log.Println("Audit error:", action, err)
+	}
+}
+
+func nullInt(n int64) any {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
+
+// auditFilter turns the query string into a WHERE clause. actor matches the
+// username, action may end in * to match a prefix (e.g. user.*), and since
+// and until take a date, "2006-01-02 15:04:05" or RFC 3339, in UTC.
+func auditFilter(r *http.Request) (string, []any, error) {
+	q := r.URL.Query()
+	where, args := []string{"1=1"}, []any{}
+	for param, column := range map[string]string{
+		"actor": "actor", "target_type": "target_type", "target_id": "target_id", "ip": "ip",
+	} {
+		if v := q.Get(param); v != "" {
+			where, args = append(where, column+" = ?"), append(args, v)
+		}
+	}
+	if v := q.Get("actor_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid actor_id")
+		}
+		where, args = append(where, "actor_id = ?"), append(args, id)
+	}
+	if v := q.Get("action"); strings.HasSuffix(v, "*") {
+		where, args = append(where, "substr(action, 1, ?) = ?"), append(args, len(v)-1, strings.TrimSuffix(v, "*"))
+	} else if v != "" {
+		where, args = append(where, "action = ?"), append(args, v)
+	}
+	for param, op := range map[string]string{"since": ">=", "until": "<"} {
+		v := q.Get(param)
+		if v == "" {
+			continue
+		}
+		t, err := parseTime(v)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid %s", param)
+		}
+		where, args = append(where, "created_at "+op+" ?"), append(args, t.UTC().Format(time.DateTime))
+	}
+	return strings.Join(where, " AND "), args, nil
+}
+
+const auditColumns = `id, COALESCE(created_at, ''), COALESCE(actor_id, 0), COALESCE(actor, ''), COALESCE(api_key_id, 0),
+	action, target_type, COALESCE(target_id, ''), COALESCE(ip, ''), before, after`
+
+func scanAuditEvent(rows interface{ Scan(...any) error }) (auditEvent, error) {
+	var e auditEvent
+	var before, after *string
+	err := rows.Scan(&e.ID, &e.CreatedAt, &e.ActorID, &e.Actor, &e.APIKeyID,
+		&e.Action, &e.TargetType, &e.TargetID, &e.IP, &before, &after)
+	if before != nil {
+		e.Before = json.RawMessage(*before)
+	}
+	if after != nil {
+		e.After = json.RawMessage(*after)
+	}
+	return e, err
+}
+
+// ----------------------- AUDIT ENDPOINTS -----------------------
+
+// listAudit serves GET /api/admin/audit, newest first, with the filters from
+// auditFilter plus limit and offset.
+func (s *Server) listAudit(w http.ResponseWriter, r *http.Request) {
+	where, args, err := auditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	limit, offset := pageParams(r, 100, 1000)
+
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM audit_events WHERE `+where, args...).Scan(&total); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	rows, err := s.db.Query(`SELECT `+auditColumns+` FROM audit_events WHERE `+where+
+		` ORDER BY id DESC LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer rows.Close()
+	events := []auditEvent{}
+	for rows.Next() {
+		e, err := scanAuditEvent(rows)
+		if err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		events = append(events, e)
+	}
+	writeJSON(w, 200, map[string]any{"events": events, "total": total, "limit": limit, "offset": offset})
+}
+
+// exportAudit serves GET /api/admin/audit/export: every matching event as
+// one JSON object per line, oldest first.
+func (s *Server) exportAudit(w http.ResponseWriter, r *http.Request) {
+	where, args, err := auditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	rows, err := s.db.Query(`SELECT `+auditColumns+` FROM audit_events WHERE `+where+` ORDER BY id`, args...)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="audit-%s.jsonl"`, time.Now().UTC().Format("20060102-150405")))
+	enc := json.NewEncoder(w)
+	for rows.Next() {
+		e, err := scanAuditEvent(rows)
+		if err != nil {
+			log.Println("Audit export error:", err)
+			return
+		}
+		if err := enc.Encode(e); err != nil {
+			return
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Audit export error:", err)
+	}
+}
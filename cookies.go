@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// ----------------------- COOKIE SESSIONS -----------------------
+
+// Browsers can keep their session in cookies instead of script-readable
+// storage by sending "X-Session-Mode: cookie" when they sign in. The access
+// and refresh tokens then go into HttpOnly cookies, so <video> tags and plain
+// links authenticate like API calls do. Because the browser sends cookies on
+// its own, cookie-authenticated requests that change something must also
+// echo the vfe_csrf cookie in an X-CSRF-Token header (double submit): another
+// site can make the browser send our cookies, but it can't read them.
+
+const (
+	accessCookie  = "vfe_access"
+	refreshCookie = "vfe_refresh"
+	csrfCookie    = "vfe_csrf"
+	csrfHeader    = "X-CSRF-Token"
+
+	// The refresh cookie is only sent to the auth endpoints.
+	refreshCookiePath = "/api/auth/"
+)
+
+func wantsCookies(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("X-Session-Mode"), "cookie")
+}
+
+// setSessionCookies stores a token pair in cookies with a fresh CSRF token,
+// which it returns.
+func (s *Server) setSessionCookies(w http.ResponseWriter, r *http.Request, access, refresh string) string {
+	csrf := newSecret()
+	sessionAge := s.cfg.RefreshTokenDays * 24 * 60 * 60
+	s.setCookie(w, r, accessCookie, access, "/", s.cfg.AccessTokenMinutes*60, true)
+	s.setCookie(w, r, refreshCookie, refresh, refreshCookiePath, sessionAge, true)
+	s.setCookie(w, r, csrfCookie, csrf, "/", sessionAge, false)
+	return csrf
+}
+
+func (s *Server) clearSessionCookies(w http.ResponseWriter, r *http.Request) {
+	s.setCookie(w, r, accessCookie, "", "/", -1, true)
+	s.setCookie(w, r, refreshCookie, "", refreshCookiePath, -1, true)
+	s.setCookie(w, r, csrfCookie, "", "/", -1, false)
+}
+
+// Lax rather than Strict so a shared /vods/ link opened from chat still
+// plays; cross-site POSTs are stopped by Lax and the CSRF check alike.
+func (s *Server) setCookie(w http.ResponseWriter, r *http.Request, name, value, path string, maxAge int, httpOnly bool) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: httpOnly,
+		Secure:   r.TLS != nil || s.cfg.SecureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// validCSRF reports whether a cookie-authenticated request may go ahead:
+// safe methods always may, anything else must carry the CSRF cookie's value
+// in the X-CSRF-Token header.
+func validCSRF(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	c, err := r.Cookie(csrfCookie)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(c.Value), []byte(r.Header.Get(csrfHeader))) == 1
+}
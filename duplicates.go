@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+)
+
+// ----------------------- CONTENT HASHING -----------------------
+
+type hashJob struct {
+	VodID int64 `json:"vod_id"`
+}
+
+func (s *Server) enqueueHash(vodID int64) {
+	if _, err := s.jobs.enqueue("hash", hashJob{VodID: vodID}, fmt.Sprintf("hash:%d", vodID)); err != nil {
+		log.Println("Hash queue error:", err)
+	}
+}
+
+// hashVod streams a VOD through SHA-256 and caches the result on its row
+// together with the size and mtime it was computed for.
+func (s *Server) hashVod(ctx context.Context, payload json.RawMessage) error {
+	var job hashJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return permanent(err)
+	}
+	var filePath string
+	err := s.db.QueryRow(`SELECT file_path FROM vods WHERE id = ?`, job.VodID).Scan(&filePath)
+	if err == sql.ErrNoRows {
+		return permanent(err)
+	} else if err != nil {
+		return err
+	}
+
+	key := vodKey(filePath)
+	info, err := s.store.Stat(ctx, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return permanent(err)
+	} else if err != nil {
+		return err
+	}
+	rc, err := s.store.OpenRange(ctx, key, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, ctxReader{ctx, rc}); err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`UPDATE vods SET content_hash = ?, hash_size = ?, hash_mtime = ? WHERE id = ?`,
+		hex.EncodeToString(h.Sum(nil)), info.Size, info.ModTime.Unix(), job.VodID)
+	return err
+}
+
+// ctxReader stops a long copy once its context is cancelled.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// ----------------------- DUPLICATE REPORT -----------------------
+
+type duplicateVod struct {
+	ID         int64  `json:"id"`
+	FilePath   string `json:"file_path"`
+	Title      string `json:"title"`
+	TeamName   string `json:"team_name"`
+	PlayerName string `json:"player_name"`
+	SizeBytes  int64  `json:"size_bytes"`
+	NoteCount  int    `json:"note_count"`
+	CreatedAt  string `json:"created_at"`
+}
+
+type duplicateGroup struct {
+	ContentHash string         `json:"content_hash"`
+	Vods        []duplicateVod `json:"vods"`
+}
+
+func (s *Server) listDuplicates(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.db.Query(`
+		SELECT v.content_hash, v.id, v.file_path, COALESCE(v.title, ''), t.name, p.name,
+			COALESCE(v.hash_size, 0), COALESCE(v.created_at, ''),
+			(SELECT COUNT(*) FROM notes n WHERE n.vod_id = v.id)
+		FROM vods v
+		JOIN players p ON p.id = v.player_id
+		JOIN teams t ON t.id = v.team_id
+		WHERE v.content_hash IN (
+			SELECT content_hash FROM vods WHERE content_hash IS NOT NULL
+			GROUP BY content_hash HAVING COUNT(*) > 1)
+		ORDER BY v.content_hash, v.id`)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer rows.Close()
+
+	groups := []duplicateGroup{}
+	for rows.Next() {
+		var hash string
+		var v duplicateVod
+		rows.Scan(&hash, &v.ID, &v.FilePath, &v.Title, &v.TeamName, &v.PlayerName, &v.SizeBytes, &v.CreatedAt, &v.NoteCount)
+		if len(groups) == 0 || groups[len(groups)-1].ContentHash != hash {
+			groups = append(groups, duplicateGroup{ContentHash: hash})
+		}
+		g := &groups[len(groups)-1]
+		g.Vods = append(g.Vods, v)
+	}
+	writeJSON(w, 200, groups)
+}
+
+// mergeDuplicates keeps one VOD of a duplicate group, moves the notes and tags
+// of the others onto it, and deletes their rows and files, archived or not.
+// Without remove_ids every other VOD with the same hash is merged.
+func (s *Server) mergeDuplicates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", 405)
+		return
+	}
+	var body struct {
+		KeepID    int64   `json:"keep_id"`
+		RemoveIDs []int64 `json:"remove_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.KeepID == 0 {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	// Scans and archive jobs must not pick up or move the files mid-merge.
+	s.tree.Lock()
+	defer s.tree.Unlock()
+
+	var hash sql.NullString
+	err := s.db.QueryRow(`SELECT content_hash FROM vods WHERE id = ?`, body.KeepID).Scan(&hash)
+	if err == sql.ErrNoRows {
+		http.Error(w, "vod not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if !hash.Valid {
+		http.Error(w, "vod has not been hashed yet", 409)
+		return
+	}
+
+	rows, err := s.db.Query(`SELECT id, file_path, archived_at IS NOT NULL FROM vods WHERE content_hash = ? AND id != ?`,
+		hash.String, body.KeepID)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	group := make(map[int64]vodFile)
+	for rows.Next() {
+		var v vodFile
+		rows.Scan(&v.ID, &v.FilePath, &v.Archived)
+		group[v.ID] = v
+	}
+	rows.Close()
+
+	if len(body.RemoveIDs) == 0 {
+		for id := range group {
+			body.RemoveIDs = append(body.RemoveIDs, id)
+		}
+	}
+	if len(body.RemoveIDs) == 0 {
+		http.Error(w, "no duplicates to merge", 400)
+		return
+	}
+	for _, id := range body.RemoveIDs {
+		if _, ok := group[id]; !ok {
+			http.Error(w, fmt.Sprintf("vod %d is not a duplicate of %d", id, body.KeepID), 400)
+			return
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer tx.Rollback()
+
+	args := []any{body.KeepID}
+	for _, id := range body.RemoveIDs {
+		args = append(args, id)
+	}
+	in := placeholders(len(body.RemoveIDs))
+	res, err := tx.Exec(`UPDATE notes SET vod_id = ? WHERE vod_id IN (`+in+`)`, args...)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	moved, _ := res.RowsAffected()
+	// Tags carry over to the kept VOD; read markers point at notes that now
+	// live there, so they are dropped rather than merged.
+	if _, err := tx.Exec(`INSERT OR IGNORE INTO vod_tags (vod_id, tag)
+		SELECT ?, tag FROM vod_tags WHERE vod_id IN (`+in+`)`, args...); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	for _, stmt := range []string{
+		`DELETE FROM vod_tags WHERE vod_id IN (` + in + `)`,
+		`DELETE FROM note_reads WHERE vod_id IN (` + in + `)`,
+		`DELETE FROM vods WHERE id IN (` + in + `)`,
+	} {
+		if _, err := tx.Exec(stmt, args[1:]...); err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "commit error", 500)
+		return
+	}
+
+	// The rows are gone, so a file we fail to delete here would simply be
+	// picked up again as a new VOD by the next scan; report it instead.
+	var leftover []string
+	for _, id := range body.RemoveIDs {
+		v := group[id]
+		st := s.store
+		if v.Archived && s.archive != nil {
+			st = s.archive
+		}
+		if err := st.Delete(r.Context(), vodKey(v.FilePath)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Println("Merge: could not remove", v.FilePath, ":", err)
+			leftover = append(leftover, v.FilePath)
+		}
+		os.RemoveAll(s.thumbs.dir(id))
+		fmt.Println("🧹 Merged duplicate:", v.FilePath)
+	}
+
+	removed := []map[string]any{}
+	for _, id := range body.RemoveIDs {
+		removed = append(removed, map[string]any{"id": id, "file_path": group[id].FilePath, "archived": group[id].Archived})
+	}
+	s.audit(r, "vod.merge_duplicates", "vod", body.KeepID,
+		map[string]any{"removed": removed}, map[string]any{"notes_moved": moved, "files_not_removed": leftover})
+
+	writeJSON(w, 200, map[string]any{
+		"ok":                true,
+		"kept":              body.KeepID,
+		"removed":           body.RemoveIDs,
+		"notes_moved":       moved,
+		"files_not_removed": leftover,
+	})
+}
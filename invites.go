@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ----------------------- INVITES -----------------------
+
+const (
+	defaultInviteHours = 72
+	maxInviteHours     = 30 * 24
+	maxInviteUses      = 1000
+)
+
+// canInvite reports whether the user may invite someone as role. Without
+// users:manage only players can be invited, and nobody is invited as admin;
+// admins are made under /api/admin/users.
+func (s *Server) canInvite(ctx context.Context, role string) bool {
+	if !s.validRole(role) || role == "admin" || !s.canGrant(ctx, role) {
+		return false
+	}
+	return role == "player" || s.can(ctx, "users:manage")
+}
+
+type Invite struct {
+	ID        int64  `json:"id"`
+	Team      string `json:"team"`
+	Player    string `json:"player,omitempty"`
+	Role      string `json:"role"`
+	MaxUses   int    `json:"max_uses"`
+	Uses      int    `json:"uses"`
+	CreatedBy string `json:"created_by"`
+	CreatedAt string `json:"created_at"`
+	ExpiresAt string `json:"expires_at"`
+	Revoked   bool   `json:"revoked"`
+}
+
+// invites serves /api/invites (GET list, POST create) and
+// /api/invites/{id} (DELETE revokes). Without users:manage you only see and
+// revoke your own.
+func (s *Server) invites(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/invites"), "/")
+	if rest == "" {
+		switch r.Method {
+		case http.MethodGet:
+			s.listInvites(w, r)
+		case http.MethodPost:
+			s.createInvite(w, r)
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+		return
+	}
+
+	id, err := strconv.ParseInt(rest, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	q, args := `UPDATE invites SET revoked_at = COALESCE(revoked_at, CURRENT_TIMESTAMP) WHERE id = ?`, []any{id}
+	if !s.can(r.Context(), "users:manage") {
+		userID, _ := userFrom(r.Context())
+		q, args = q+` AND created_by = ?`, append(args, userID)
+	}
+	res, err := s.db.Exec(q, args...)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "invite not found", 404)
+		return
+	}
+	s.audit(r, "invite.revoke", "invite", id, nil, nil)
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
+
+// listInvites shows open invites; ?all=true includes used up, expired and
+// revoked ones.
+func (s *Server) listInvites(w http.ResponseWriter, r *http.Request) {
+	userID, _ := userFrom(r.Context())
+	limit, offset := pageParams(r, 50, 500)
+
+	query := `SELECT i.id, t.name, COALESCE(p.name, ''), i.role, i.max_uses, i.uses, COALESCE(u.username, ''),
+		COALESCE(i.created_at, ''), i.expires_at, i.revoked_at IS NOT NULL
+		FROM invites i JOIN teams t ON t.id = i.team_id LEFT JOIN players p ON p.id = i.player_id
+		LEFT JOIN users u ON u.id = i.created_by
+		WHERE 1=1`
+	var args []any
+	if !s.can(r.Context(), "users:manage") {
+		query += ` AND i.created_by = ?`
+		args = append(args, userID)
+	}
+	if r.URL.Query().Get("all") != "true" {
+		query += ` AND i.revoked_at IS NULL AND i.uses < i.max_uses AND i.expires_at > ?`
+		args = append(args, time.Now().Unix())
+	}
+	query += ` ORDER BY i.id DESC LIMIT ? OFFSET ?`
+	args = append(args, limit, offset)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer rows.Close()
+	invites := []Invite{}
+	for rows.Next() {
+		var inv Invite
+		var expires int64
+		if err := rows.Scan(&inv.ID, &inv.Team, &inv.Player, &inv.Role, &inv.MaxUses, &inv.Uses, &inv.CreatedBy,
+			&inv.CreatedAt, &expires, &inv.Revoked); err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		inv.ExpiresAt = time.Unix(expires, 0).UTC().Format(time.DateTime)
+		invites = append(invites, inv)
+	}
+	writeJSON(w, 200, map[string]any{"invites": invites, "limit": limit, "offset": offset})
+}
+
+// createInvite takes {team, player, role, max_uses, expires_hours} and
+// returns the link. The token is only shown here. An invite naming a player
+// links the new account to that player profile, so it can only be used once.
+func (s *Server) createInvite(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Team         string `json:"team"`
+		Player       string `json:"player"`
+		Role         string `json:"role"`
+		MaxUses      int    `json:"max_uses"`
+		ExpiresHours int    `json:"expires_hours"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	userID, _ := userFrom(r.Context())
+	body.Team = strings.TrimSpace(body.Team)
+	body.Player = strings.TrimSpace(body.Player)
+	if body.Role == "" {
+		body.Role = "player"
+	}
+	if !s.canInvite(r.Context(), body.Role) {
+		http.Error(w, "you can't invite that role", 403)
+		return
+	}
+	if body.MaxUses == 0 {
+		body.MaxUses = 1
+	}
+	if body.MaxUses < 0 || body.MaxUses > maxInviteUses {
+		http.Error(w, fmt.Sprintf("max_uses must be between 1 and %d", maxInviteUses), 400)
+		return
+	}
+	if body.Player != "" && body.MaxUses != 1 {
+		http.Error(w, "an invite for a player can only be used once", 400)
+		return
+	}
+	if body.ExpiresHours == 0 {
+		body.ExpiresHours = defaultInviteHours
+	}
+	if body.ExpiresHours < 0 || body.ExpiresHours > maxInviteHours {
+		http.Error(w, fmt.Sprintf("expires_hours must be between 1 and %d", maxInviteHours), 400)
+		return
+	}
+
+	var teamID int64
+	err := s.db.QueryRow(`SELECT id FROM teams WHERE name = ?`, body.Team).Scan(&teamID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "team not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if !s.requireTeam(w, r, "invites:create", teamID) {
+		return
+	}
+
+	var playerID any
+	if body.Player != "" {
+		var id int64
+		var linked sql.NullInt64
+		err := s.db.QueryRow(`SELECT id, user_id FROM players WHERE team_id = ? AND name = ?`, teamID, body.Player).
+			Scan(&id, &linked)
+		if err == sql.ErrNoRows {
+			http.Error(w, "player not found", 404)
+			return
+		} else if err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		if linked.Valid {
+			http.Error(w, "that player is already linked to an account", 409)
+			return
+		}
+		playerID = id
+	}
+
+	token := newSecret()
+	expires := time.Now().Add(time.Duration(body.ExpiresHours) * time.Hour)
+	res, err := s.db.Exec(`INSERT INTO invites (token_hash, team_id, player_id, role, max_uses, created_by, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, hashSecret(token), teamID, playerID, body.Role, body.MaxUses, userID, expires.Unix())
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	id, _ := res.LastInsertId()
+	s.audit(r, "invite.create", "invite", id, nil, map[string]any{
+		"team": body.Team, "player": body.Player, "role": body.Role, "max_uses": body.MaxUses, "expires_hours": body.ExpiresHours,
+	})
+	writeJSON(w, 201, map[string]any{
+		"id":         id,
+		"team":       body.Team,
+		"player":     body.Player,
+		"role":       body.Role,
+		"max_uses":   body.MaxUses,
+		"token":      token,
+		"invite_url": "/index.html?invite=" + url.QueryEscape(token),
+		"expires_at": expires.UTC().Format(time.DateTime),
+	})
+}
+
+type openedInvite struct {
+	ID, TeamID int64
+	Team, Role string
+	PlayerID   int64 // 0 unless the invite is for a player profile
+	Player     string
+}
+
+// openInvite finds a usable invite by its token.
+func openInvite(q interface {
+	QueryRow(string, ...any) *sql.Row
+}, token string) (inv openedInvite, err error) {
+	err = q.QueryRow(`SELECT i.id, i.team_id, t.name, i.role, COALESCE(p.id, 0), COALESCE(p.name, '')
+		FROM invites i JOIN teams t ON t.id = i.team_id LEFT JOIN players p ON p.id = i.player_id
+		WHERE i.token_hash = ? AND i.revoked_at IS NULL AND i.uses < i.max_uses AND i.expires_at > ?`,
+		hashSecret(token), time.Now().Unix()).Scan(&inv.ID, &inv.TeamID, &inv.Team, &inv.Role, &inv.PlayerID, &inv.Player)
+	return
+}
+
+// lookupInvite lets the signup page show what an invite is for. No login
+// needed.
+func (s *Server) lookupInvite(w http.ResponseWriter, r *http.Request) {
+	inv, err := openInvite(s.db, r.URL.Query().Get("token"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "invite is invalid or has expired", 404)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	writeJSON(w, 200, map[string]any{"team": inv.Team, "player": inv.Player, "role": inv.Role})
+}
+
+// acceptInvite creates the account, adds it to the invite's team and signs
+// it in. No login needed.
+func (s *Server) acceptInvite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", 405)
+		return
+	}
+	var body struct {
+		Token       string `json:"token"`
+		Username    string `json:"username"`
+		Password    string `json:"password"`
+		DisplayName string `json:"display_name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Token == "" {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	body.Username = strings.TrimSpace(body.Username)
+	if body.Username == "" {
+		http.Error(w, "missing username", 400)
+		return
+	}
+	if err := checkNewPassword(body.Password); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	hash, _ := bcrypt.GenerateFromPassword([]byte(body.Password), bcrypt.DefaultCost)
+	var displayName any
+	if dn := strings.TrimSpace(body.DisplayName); dn != "" {
+		displayName = dn
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer tx.Rollback()
+	inv, err := openInvite(tx, body.Token)
+	if err == sql.ErrNoRows {
+		http.Error(w, "invite is invalid or has expired", 400)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	// The uses check is repeated here so two signups can't share the last use.
+	res, err := tx.Exec(`UPDATE invites SET uses = uses + 1 WHERE id = ? AND uses < max_uses`, inv.ID)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "invite is invalid or has expired", 400)
+		return
+	}
+	role := inv.Role
+	res, err = tx.Exec(`INSERT INTO users (username, password_hash, role, display_name, invite_id) VALUES (?, ?, ?, ?, ?)`,
+		body.Username, hash, role, displayName, inv.ID)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			http.Error(w, "username already taken", 409)
+			return
+		}
+		http.Error(w, "db error", 500)
+		return
+	}
+	userID, _ := res.LastInsertId()
+	if _, err := tx.Exec(`INSERT INTO memberships (user_id, team_id) VALUES (?, ?)`, userID, inv.TeamID); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if inv.PlayerID != 0 {
+		res, err := tx.Exec(`UPDATE players SET user_id = ? WHERE id = ? AND user_id IS NULL`, userID, inv.PlayerID)
+		if err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "that player is already linked to an account", 409)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "commit error", 500)
+		return
+	}
+	fmt.Printf("👋 %s joined %s as %s\n", body.Username, inv.Team, role)
+	s.auditAs(r, userID, "invite.accept", "user", userID, nil, map[string]any{
+		"invite_id": inv.ID, "username": body.Username, "team": inv.Team, "player": inv.Player, "role": role,
+	})
+	s.startSession(w, r, sessionUser{ID: userID, Username: body.Username, Role: role})
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------------- JOB QUEUE -----------------------
+
+// Jobs are stored in the jobs table so queued and interrupted work survives
+// a restart. A single dispatcher claims due jobs and runs each in its own
+// goroutine, bounded by the total worker count and a per-type limit.
+
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+
+	jobBaseBackoff = 5 * time.Second
+	jobMaxBackoff  = 10 * time.Minute
+	jobPollEvery   = 2 * time.Second
+	jobKeepDone    = 7 * 24 * time.Hour
+)
+
+type Job struct {
+	ID          int64           `json:"id"`
+	Type        string          `json:"type"`
+	Payload     json.RawMessage `json:"payload"`
+	DedupeKey   string          `json:"dedupe_key,omitempty"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       time.Time       `json:"run_at"`
+	LastError   string          `json:"last_error,omitempty"`
+	CreatedAt   string          `json:"created_at"`
+	StartedAt   string          `json:"started_at,omitempty"`
+	FinishedAt  string          `json:"finished_at,omitempty"`
+}
+
+type jobHandler func(ctx context.Context, payload json.RawMessage) error
+
+type jobType struct {
+	handler     jobHandler
+	concurrency int
+	maxAttempts int
+}
+
+// errPermanent marks a job error that retrying can't fix.
+type errPermanent struct{ err error }
+
+func (e errPermanent) Error() string { return e.err.Error() }
+func (e errPermanent) Unwrap() error { return e.err }
+
+func permanent(err error) error { return errPermanent{err} }
+
+type jobQueue struct {
+	db      *sql.DB
+	workers int
+	limits  map[string]int
+	types   map[string]*jobType
+	wake    chan struct{}
+
+	mu      sync.Mutex
+	running map[string]int
+	total   int
+	cancels map[int64]context.CancelFunc
+}
+
+func newJobQueue(db *sql.DB, workers int, limits map[string]int) *jobQueue {
+	if workers <= 0 {
+		workers = 4
+	}
+	return &jobQueue{
+		db:      db,
+		workers: workers,
+		limits:  limits,
+		types:   make(map[string]*jobType),
+		wake:    make(chan struct{}, 1),
+		running: make(map[string]int),
+		cancels: make(map[int64]context.CancelFunc),
+	}
+}
+
+// register adds a job type. concurrency is the default number of jobs of this
+// type that may run at once; jobConcurrency in config.json overrides it.
+func (q *jobQueue) register(name string, concurrency, maxAttempts int, h jobHandler) {
+	if n, ok := q.limits[name]; ok && n > 0 {
+		concurrency = n
+	}
+	q.types[name] = &jobType{handler: h, concurrency: concurrency, maxAttempts: maxAttempts}
+}
+
+// enqueue stores a job to run as soon as a worker is free. When dedupeKey is
+// set and a job with the same key is already queued or running, nothing is
+// added and the returned ID is 0.
+func (q *jobQueue) enqueue(typ string, payload any, dedupeKey string) (int64, error) {
+	return q.enqueueAt(typ, payload, dedupeKey, time.Now())
+}
+
+func (q *jobQueue) enqueueAt(typ string, payload any, dedupeKey string, runAt time.Time) (int64, error) {
+	t, ok := q.types[typ]
+	if !ok {
+		return 0, fmt.Errorf("unknown job type %q", typ)
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	var key any
+	if dedupeKey != "" {
+		key = dedupeKey
+	}
+	res, err := q.db.Exec(`INSERT OR IGNORE INTO jobs (type, payload, dedupe_key, max_attempts, run_at) VALUES (?, ?, ?, ?, ?)`,
+		typ, string(b), key, t.maxAttempts, runAt.Unix())
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, nil
+	}
+	q.notify()
+	return res.LastInsertId()
+}
+
+func (q *jobQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// start requeues jobs that were running when the server last stopped and
+// launches the dispatcher.
+func (q *jobQueue) start(ctx context.Context) error {
+	res, err := q.db.Exec(`UPDATE jobs SET status = ?, run_at = ? WHERE status = ?`, jobQueued, time.Now().Unix(), jobRunning)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		fmt.Println("♻️ Requeued", n, "interrupted job(s)")
+	}
+	q.db.Exec(`DELETE FROM jobs WHERE status = ? AND finished_at < ?`,
+		jobSucceeded, time.Now().Add(-jobKeepDone).UTC().Format(time.DateTime))
+
+	go q.dispatch(ctx)
+	return nil
+}
+
+func (q *jobQueue) dispatch(ctx context.Context) {
+	ticker := time.NewTicker(jobPollEvery)
+	defer ticker.Stop()
+	for {
+		for q.claimNext(ctx) {
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// claimNext starts one due job if a worker is free, reporting whether it did.
+func (q *jobQueue) claimNext(ctx context.Context) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.total >= q.workers {
+		return false
+	}
+
+	var open []any
+	for name, t := range q.types {
+		if q.running[name] < t.concurrency {
+			open = append(open, name)
+		}
+	}
+	if len(open) == 0 {
+		return false
+	}
+
+	query := `UPDATE jobs SET status = 'running', attempts = attempts + 1, started_at = CURRENT_TIMESTAMP, finished_at = NULL
+		WHERE id = (SELECT id FROM jobs WHERE status = 'queued' AND run_at <= ? AND type IN (` + placeholders(len(open)) + `)
+			ORDER BY run_at, id LIMIT 1)
+		RETURNING id, type, payload, attempts, max_attempts`
+	args := append([]any{time.Now().Unix()}, open...)
+
+	var job Job
+	var payload string
+	err := q.db.QueryRow(query, args...).Scan(&job.ID, &job.Type, &payload, &job.Attempts, &job.MaxAttempts)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println("Job claim error:", err)
+		}
+		return false
+	}
+	job.Payload = json.RawMessage(payload)
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	q.running[job.Type]++
+	q.total++
+	q.cancels[job.ID] = cancel
+	go q.run(jobCtx, job)
+	return true
+}
+
+func (q *jobQueue) run(ctx context.Context, job Job) {
+	defer q.notify()
+	err := q.safeRun(ctx, job)
+
+	q.mu.Lock()
+	q.cancels[job.ID]()
+	delete(q.cancels, job.ID)
+	q.running[job.Type]--
+	q.total--
+	q.mu.Unlock()
+
+	if err == nil {
+		q.db.Exec(`UPDATE jobs SET status = ?, last_error = NULL, finished_at = CURRENT_TIMESTAMP WHERE id = ? AND status = ?`,
+			jobSucceeded, job.ID, jobRunning)
+		return
+	}
+
+	var perm errPermanent
+	if errors.As(err, &perm) || job.Attempts >= job.MaxAttempts {
+		log.Printf("Job %d (%s) failed: %v", job.ID, job.Type, err)
+		q.db.Exec(`UPDATE jobs SET status = ?, last_error = ?, finished_at = CURRENT_TIMESTAMP WHERE id = ? AND status = ?`,
+			jobFailed, err.Error(), job.ID, jobRunning)
+		return
+	}
+	retryAt := time.Now().Add(jobBackoff(job.Attempts))
+	q.db.Exec(`UPDATE jobs SET status = ?, last_error = ?, run_at = ? WHERE id = ? AND status = ?`,
+		jobQueued, err.Error(), retryAt.Unix(), job.ID, jobRunning)
+}
+
+// safeRun keeps a panicking handler from taking the whole server down.
+func (q *jobQueue) safeRun(ctx context.Context, job Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = permanent(fmt.Errorf("panic: %v", r))
+		}
+	}()
+	t, ok := q.types[job.Type]
+	if !ok {
+		return permanent(fmt.Errorf("unknown job type %q", job.Type))
+	}
+	return t.handler(ctx, job.Payload)
+}
+
+func jobBackoff(attempt int) time.Duration {
+	d := jobBaseBackoff
+	for i := 1; i < attempt && d < jobMaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, jobMaxBackoff)
+}
+
+// cancel stops a queued or running job. Running handlers see their context
+// cancelled and are expected to return promptly.
+func (q *jobQueue) cancel(id int64) (bool, error) {
+	res, err := q.db.Exec(`UPDATE jobs SET status = ?, finished_at = CURRENT_TIMESTAMP WHERE id = ? AND status IN (?, ?)`,
+		jobCancelled, id, jobQueued, jobRunning)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	q.mu.Lock()
+	if cancel, ok := q.cancels[id]; ok {
+		cancel()
+	}
+	q.mu.Unlock()
+	return true, nil
+}
+
+// retry puts a failed or cancelled job back in the queue with a fresh set of attempts.
+func (q *jobQueue) retry(id int64) (bool, error) {
+	res, err := q.db.Exec(`UPDATE jobs SET status = ?, attempts = 0, last_error = NULL, run_at = ?, started_at = NULL, finished_at = NULL
+		WHERE id = ? AND status IN (?, ?)`, jobQueued, time.Now().Unix(), id, jobFailed, jobCancelled)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			// an identical job is already queued or running
+			return false, nil
+		}
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	q.notify()
+	return true, nil
+}
+
+// recentlyFailed reports whether a job with this key failed within the window,
+// so callers that enqueue on demand don't keep retrying a broken input.
+func (q *jobQueue) recentlyFailed(dedupeKey string, window time.Duration) bool {
+	var count int
+	q.db.QueryRow(`SELECT COUNT(*) FROM jobs WHERE dedupe_key = ? AND status = ? AND finished_at > ?`,
+		dedupeKey, jobFailed, time.Now().Add(-window).UTC().Format(time.DateTime)).Scan(&count)
+	return count > 0
+}
+
+func placeholders(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	b := make([]byte, 0, n*2)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, '?')
+	}
+	return string(b)
+}
+
+// registerJobs wires up every job type the server knows how to run.
+func (s *Server) registerJobs() {
+	s.jobs.register("scan", 1, 3, func(ctx context.Context, _ json.RawMessage) error {
+		if err := s.ScanStorage(); err != nil {
+			return err
+		}
+		s.thumbs.enqueueMissing()
+		return nil
+	})
+	s.jobs.register("thumbnails", 1, 3, s.thumbs.handle)
+	s.jobs.register("hash", 2, 3, s.hashVod)
+	s.jobs.register("probe", 2, 3, s.probeVod)
+	s.jobs.register("retention", 1, 3, s.runRetention)
+	s.jobs.register("archive", 1, 5, s.archiveVod)
+	s.jobs.register("restore", 1, 5, s.restoreVod)
+}
+
+// ----------------------- JOB ADMIN ENDPOINTS -----------------------
+
+func (s *Server) listJobs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit, offset := pageParams(r, 50, 500)
+
+	query := `SELECT id, type, payload, COALESCE(dedupe_key, ''), status, attempts, max_attempts, run_at,
+		COALESCE(last_error, ''), COALESCE(created_at, ''), COALESCE(started_at, ''), COALESCE(finished_at, '')
+		FROM jobs WHERE 1=1`
+	var args []any
+	if v := q.Get("status"); v != "" {
+		query += ` AND status = ?`
+		args = append(args, v)
+	}
+	if v := q.Get("type"); v != "" {
+		query += ` AND type = ?`
+		args = append(args, v)
+	}
+	query += ` ORDER BY id DESC LIMIT ? OFFSET ?`
+	args = append(args, limit, offset)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		var j Job
+		var payload string
+		var runAt int64
+		rows.Scan(&j.ID, &j.Type, &payload, &j.DedupeKey, &j.Status, &j.Attempts, &j.MaxAttempts, &runAt,
+			&j.LastError, &j.CreatedAt, &j.StartedAt, &j.FinishedAt)
+		j.Payload = json.RawMessage(payload)
+		j.RunAt = time.Unix(runAt, 0).UTC()
+		jobs = append(jobs, j)
+	}
+	writeJSON(w, 200, map[string]any{"jobs": jobs, "limit": limit, "offset": offset})
+}
+
+func (s *Server) retryJob(w http.ResponseWriter, r *http.Request) {
+	s.jobAction(w, r, s.jobs.retry, "job.retry", "retried")
+}
+
+func (s *Server) cancelJob(w http.ResponseWriter, r *http.Request) {
+	s.jobAction(w, r, s.jobs.cancel, "job.cancel", "cancelled")
+}
+
+func (s *Server) jobAction(w http.ResponseWriter, r *http.Request, action func(int64) (bool, error), auditAction, done string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", 405)
+		return
+	}
+	var body struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ID == 0 {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	ok, err := action(body.ID)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if !ok {
+		http.Error(w, "job not found or not in a state that allows this", 409)
+		return
+	}
+	s.audit(r, auditAction, "job", body.ID, nil, map[string]any{"status": done})
+	writeJSON(w, 200, map[string]string{"ok": "true", "status": done, "id": strconv.FormatInt(body.ID, 10)})
+}
+
+func (s *Server) enqueueScan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", 405)
+		return
+	}
+	id, err := s.jobs.enqueue("scan", struct{}{}, "scan")
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	s.audit(r, "scan.start", "job", id, nil, nil)
+	writeJSON(w, 200, map[string]any{"ok": true, "job_id": id})
+}
+
+// pageParams reads limit/offset query parameters, clamping limit to max.
+func pageParams(r *http.Request, def, max int) (int, int) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = def
+	}
+	if limit > max {
+		limit = max
+	}
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ----------------------- LOGIN THROTTLING -----------------------
+
+// LoginConfig limits password guessing. Failures are counted per username
+// and per client IP since the last successful login, within lockoutMinutes.
+// Each failure on a username doubles the wait before its next attempt (up to
+// a minute). An IP only starts backing off once it has failed more often
+// than one username may, so people sharing a LAN address don't slow each
+// other down. Reaching the max locks the username or IP out for
+// lockoutMinutes.
+type LoginConfig struct {
+	MaxFailures    int `json:"maxFailures"`    // per username, default 5
+	MaxIPFailures  int `json:"maxIPFailures"`  // per IP, default 20
+	LockoutMinutes int `json:"lockoutMinutes"` // default 15
+}
+
+const maxLoginBackoff = time.Minute
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// initDummyHash is called at startup so the first unknown-username login
+// doesn't pay for generating the hash.
+func initDummyHash() {
+	dummyHashOnce.Do(func() {
+		b := make([]byte, 16)
+		rand.Read(b)
+		dummyHash, _ = bcrypt.GenerateFromPassword(b, bcrypt.DefaultCost)
+	})
+}
+
+// compareDummyHash burns the same bcrypt time as a real check, so unknown
+// usernames can't be told apart by how long login takes.
+func compareDummyHash(password string) {
+	initDummyHash()
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+// recordLogin adds a row to the login_attempts audit table. reason is empty
+// for successes and says why otherwise.
+func (s *Server) recordLogin(r *http.Request, username string, success bool, reason string) {
+	if len(username) > 200 {
+		username = username[:200]
+	}
+	_, err := s.db.Exec(`INSERT INTO login_attempts (username, ip, user_agent, success, reason, at)
+		VALUES (?, ?, ?, ?, ?, ?)`, username, clientIP(r), r.UserAgent(), success, reason, time.Now().Unix())
+	if err != nil {
+		log.Println("Login audit error:", err)
+	}
+}
+
+// beginLogin reserves a login attempt for username before its credentials
+// are checked, and returns the attempt's id and how long the client must
+// still wait. The attempt is written as a pending failure first: that takes
+// the database's write lock, so concurrent attempts are counted one after
+// the other and each sees those still in flight. A throttled attempt is
+// settled on the spot; otherwise the caller settles it with endLogin.
+func (s *Server) beginLogin(r *http.Request, username string) (int64, time.Duration, error) {
+	if len(username) > 200 {
+		username = username[:200]
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`INSERT INTO login_attempts (username, ip, user_agent, success, reason, at)
+		VALUES (?, ?, ?, 0, 'pending', ?)`, username, clientIP(r), r.UserAgent(), time.Now().Unix())
+	if err != nil {
+		return 0, 0, err
+	}
+	id, _ := res.LastInsertId()
+	wait, err := s.loginWait(tx, username, clientIP(r), id)
+	if err != nil {
+		return 0, 0, err
+	}
+	if wait > 0 {
+		if _, err := tx.Exec(`UPDATE login_attempts SET reason = 'throttled' WHERE id = ?`, id); err != nil {
+			return 0, 0, err
+		}
+	}
+	return id, wait, tx.Commit()
+}
+
+// endLogin settles an attempt reserved by beginLogin. reason is empty for
+// successes and says why otherwise. Only the first call for an attempt
+// counts, so callers can defer endLogin(id, false, "error") to settle it on
+// paths that fail for reasons of our own.
+func (s *Server) endLogin(id int64, success bool, reason string) {
+	if _, err := s.db.Exec(`UPDATE login_attempts SET success = ?, reason = ? WHERE id = ? AND reason = 'pending'`,
+		success, reason, id); err != nil {
+		log.Println("Login audit error:", err)
+	}
+}
+
+// loginWait returns how long a client must wait before trying this username
+// again, considering both the username's and the IP's failures before the
+// attempt with id before.
+func (s *Server) loginWait(tx *sql.Tx, username, ip string, before int64) (time.Duration, error) {
+	cfg := s.cfg.Login
+	byUser, err := s.failureWait(tx, "username", username, before, 1, cfg.MaxFailures)
+	if err != nil {
+		return 0, err
+	}
+	byIP, err := s.failureWait(tx, "ip", ip, before, cfg.MaxFailures, cfg.MaxIPFailures)
+	if err != nil {
+		return 0, err
+	}
+	return max(byUser, byIP), nil
+}
+
+// failureWait looks at failures for one column (username or ip) since its
+// last success. Attempts still pending count as failures; throttled ones,
+// passwords awaiting a second factor and server errors don't. Backoff starts at the
+// free'th failure. column is never user input.
+func (s *Server) failureWait(tx *sql.Tx, column, value string, before int64, free, maxFailures int) (time.Duration, error) {
+	lockout := time.Duration(s.cfg.Login.LockoutMinutes) * time.Minute
+	now := time.Now()
+
+	var count int
+	var last int64
+	err := tx.QueryRow(fmt.Sprintf(`SELECT COUNT(*), COALESCE(MAX(at), 0) FROM login_attempts
+		WHERE %[1]s = ? AND success = 0 AND reason NOT IN ('throttled', 'mfa_required', 'error') AND at > ? AND id < ?
+		AND id > COALESCE((SELECT MAX(id) FROM login_attempts WHERE %[1]s = ? AND success = 1 AND id < ?), 0)`, column),
+		value, now.Add(-lockout).Unix(), before, value, before).Scan(&count, &last)
+	if err != nil || count < free {
+		return 0, err
+	}
+
+	wait := lockout
+	if count < maxFailures {
+		wait = min(time.Second<<min(count-free, 10), maxLoginBackoff)
+	}
+	return time.Until(time.Unix(last, 0).Add(wait)), nil
+}
+
+func retryAfter(w http.ResponseWriter, wait time.Duration) {
+	secs := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(max(secs, 1)))
+	http.Error(w, "too many failed attempts, try again later", 429)
+}
+
+// ----------------------- LOGIN AUDIT ENDPOINTS -----------------------
+
+type loginAttempt struct {
+	ID        int64  `json:"id"`
+	Username  string `json:"username"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	Success   bool   `json:"success"`
+	Reason    string `json:"reason,omitempty"`
+	At        string `json:"at"`
+}
+
+// listLoginAttempts filters by ?username=, ?ip= and ?success=true|false.
+func (s *Server) listLoginAttempts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit, offset := pageParams(r, 100, 1000)
+
+	query := `SELECT id, username, COALESCE(ip, ''), COALESCE(user_agent, ''), success, COALESCE(reason, ''), at
+		FROM login_attempts WHERE 1=1`
+	var args []any
+	if v := q.Get("username"); v != "" {
+		query += ` AND username = ?`
+		args = append(args, v)
+	}
+	if v := q.Get("ip"); v != "" {
+		query += ` AND ip = ?`
+		args = append(args, v)
+	}
+	switch q.Get("success") {
+	case "true":
+		query += ` AND success = 1`
+	case "false":
+		query += ` AND success = 0`
+	}
+	query += ` ORDER BY id DESC LIMIT ? OFFSET ?`
+	args = append(args, limit, offset)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer rows.Close()
+	attempts := []loginAttempt{}
+	for rows.Next() {
+		var a loginAttempt
+		var at int64
+		rows.Scan(&a.ID, &a.Username, &a.IP, &a.UserAgent, &a.Success, &a.Reason, &at)
+		a.At = time.Unix(at, 0).UTC().Format(time.DateTime)
+		attempts = append(attempts, a)
+	}
+	writeJSON(w, 200, map[string]any{"attempts": attempts, "limit": limit, "offset": offset})
+}
+
+// unlockLogin clears a lockout early by recording an admin unlock, which
+// counts as a success for the username (and IP, if given).
+func (s *Server) unlockLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", 405)
+		return
+	}
+	var body struct {
+		Username string `json:"username"`
+		IP       string `json:"ip"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || (body.Username == "" && body.IP == "") {
+		http.Error(w, "username or ip required", 400)
+		return
+	}
+	_, err := s.db.Exec(`INSERT INTO login_attempts (username, ip, user_agent, success, reason, at)
+		VALUES (?, ?, ?, 1, 'admin_unlock', ?)`, body.Username, body.IP, r.UserAgent(), time.Now().Unix())
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	s.audit(r, "login.unlock", "login", body.Username, nil, map[string]any{"username": body.Username, "ip": body.IP})
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
@@ -0,0 +1,830 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------------------- MATCHES -----------------------
+
+// A match groups the VODs recorded in one game. A scrim gives one POV per
+// player, each in that player's own folder. A match belongs to a team and
+// only takes VODs attributed to that team (vods.team_id). Match notes are
+// written against the match rather than one VOD, so every POV shows them.
+//
+// vods.recorded_at is when a recording started. It comes from the timestamp
+// OBS, ShadowPlay and Game Bar put in their filenames, read in the server's
+// time zone, or from the file's modification time when a scan finds one
+// without. Once probed, the MP4 header's creation time (mp4.go) takes
+// precedence. Auto-grouping clusters a team's unassigned VODs on the result.
+
+var (
+	matchTypes   = []string{"scrim", "official", "practice"}
+	matchResults = []string{"win", "loss", "draw"}
+)
+
+const (
+	maxMatchField      = 60
+	defaultGroupWindow = 10 // minutes
+	maxGroupWindow     = 240
+)
+
+// "2026-10-18 20-15-03" (OBS, Game Bar) or "2026.10.18 - 20.15.03" (ShadowPlay)
+var filenameTime = regexp.MustCompile(`(\d{4})[-._](\d{2})[-._](\d{2})[ _T]+(?:-\s*)?(\d{2})[-.:_](\d{2})[-.:_](\d{2})`)
+
+// recordedAt is the recorded_at value for a VOD file: the filename's
+// timestamp, else fallback, else NULL when fallback is zero.
+func recordedAt(filename string, fallback time.Time) any {
+	if m := filenameTime.FindStringSubmatch(filename); m != nil {
+		t, err := time.ParseInLocation(time.DateTime, fmt.Sprintf("%s-%s-%s %s:%s:%s", m[1], m[2], m[3], m[4], m[5], m[6]), time.Local)
+		if err == nil {
+			return t.UTC().Format(time.DateTime)
+		}
+	}
+	if fallback.IsZero() {
+		return nil
+	}
+	return fallback.UTC().Format(time.DateTime)
+}
+
+type Match struct {
+	ID        int64  `json:"id"`
+	TeamID    int64  `json:"team_id"`
+	Team      string `json:"team"`
+	Type      string `json:"type"`
+	Opponent  string `json:"opponent"`
+	Map       string `json:"map"`
+	PlayedAt  string `json:"played_at"`
+	Result    string `json:"result"`
+	Score     string `json:"score"`
+	CreatedBy int64  `json:"created_by,omitempty"`
+	CreatedAt string `json:"created_at"`
+	VodCount  int    `json:"vod_count"`
+	NoteCount int    `json:"note_count"`
+}
+
+const matchColumns = `m.id, m.team_id, t.name, m.type, COALESCE(m.opponent, ''), COALESCE(m.map, ''),
+	COALESCE(m.played_at, ''), COALESCE(m.result, ''), COALESCE(m.score, ''), COALESCE(m.created_by, 0),
+	COALESCE(m.created_at, ''), (SELECT COUNT(*) FROM vods v WHERE v.match_id = m.id),
+	(SELECT COUNT(*) FROM match_notes n WHERE n.match_id = m.id)`
+
+func scanMatch(row interface{ Scan(...any) error }) (Match, error) {
+	var m Match
+	err := row.Scan(&m.ID, &m.TeamID, &m.Team, &m.Type, &m.Opponent, &m.Map, &m.PlayedAt, &m.Result, &m.Score,
+		&m.CreatedBy, &m.CreatedAt, &m.VodCount, &m.NoteCount)
+	return m, err
+}
+
+func (s *Server) match(id int64) (Match, error) {
+	return scanMatch(s.db.QueryRow(`SELECT `+matchColumns+` FROM matches m JOIN teams t ON t.id = m.team_id
+		WHERE m.id = ?`, id))
+}
+
+type matchVod struct {
+	ID         int64  `json:"id"`
+	Title      string `json:"title"`
+	FilePath   string `json:"file_path"`
+	PlayerID   int64  `json:"player_id"`
+	Player     string `json:"player"`
+	RecordedAt string `json:"recorded_at"`
+	// StartedAt is the best guess at when recording started: the MP4's own
+	// creation time if it has one, else recorded_at.
+	StartedAt string `json:"started_at"`
+	Archived  bool   `json:"archived"`
+	// Offset is the match time the recording starts at; see timeline.go.
+	Offset       *float64 `json:"offset"`
+	OffsetSource string   `json:"offset_source,omitempty"`
+}
+
+const matchVodColumns = `v.id, COALESCE(v.title, ''), v.file_path, v.player_id, p.name,
+	COALESCE(v.recorded_at, ''), COALESCE(v.media_created_at, v.recorded_at, ''), v.archived_at IS NOT NULL, v.match_offset, COALESCE(v.offset_source, '')`
+
+func (s *Server) matchVods(where string, args ...any) ([]matchVod, error) {
+	rows, err := s.db.Query(`SELECT `+matchVodColumns+` FROM vods v JOIN players p ON p.id = v.player_id
+		WHERE `+where+` ORDER BY COALESCE(v.media_created_at, v.recorded_at), v.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	vods := []matchVod{}
+	for rows.Next() {
+		var v matchVod
+		if err := rows.Scan(&v.ID, &v.Title, &v.FilePath, &v.PlayerID, &v.Player, &v.RecordedAt, &v.StartedAt, &v.Archived,
+			&v.Offset, &v.OffsetSource); err != nil {
+			return nil, err
+		}
+		vods = append(vods, v)
+	}
+	return vods, rows.Err()
+}
+
+// matchPatch is the body of PATCH /api/matches/{id}, and part of the body
+// of POST /api/matches. Fields left out stay as they are; an empty string
+// clears one.
+type matchPatch struct {
+	Type     *string `json:"type"`
+	Opponent *string `json:"opponent"`
+	Map      *string `json:"map"`
+	PlayedAt *string `json:"played_at"`
+	Result   *string `json:"result"`
+	Score    *string `json:"score"`
+}
+
+func (b *matchPatch) validate() error {
+	for field, v := range map[string]*string{"opponent": b.Opponent, "map": b.Map, "score": b.Score} {
+		if v == nil {
+			continue
+		}
+		*v = strings.TrimSpace(*v)
+		if len(*v) > maxMatchField {
+			return fmt.Errorf("%s is too long (max %d characters)", field, maxMatchField)
+		}
+	}
+	if b.Type != nil && !slices.Contains(matchTypes, *b.Type) {
+		return fmt.Errorf("type must be one of %s", strings.Join(matchTypes, ", "))
+	}
+	if b.Result != nil && *b.Result != "" && !slices.Contains(matchResults, *b.Result) {
+		return fmt.Errorf("result must be empty or one of %s", strings.Join(matchResults, ", "))
+	}
+	if b.PlayedAt != nil && *b.PlayedAt != "" {
+		t, err := parseTime(*b.PlayedAt)
+		if err != nil {
+			return fmt.Errorf("played_at: %v", err)
+		}
+		*b.PlayedAt = t.UTC().Format(time.DateTime)
+	}
+	return nil
+}
+
+func (b *matchPatch) apply(tx *sql.Tx, id int64) error {
+	sets, args := []string{}, []any{}
+	for column, v := range map[string]*string{"opponent": b.Opponent, "map": b.Map, "played_at": b.PlayedAt,
+		"result": b.Result, "score": b.Score} {
+		if v != nil {
+			sets, args = append(sets, column+" = ?"), append(args, nullString(*v))
+		}
+	}
+	if b.Type != nil {
+		sets, args = append(sets, "type = ?"), append(args, *b.Type)
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+	_, err := tx.Exec(`UPDATE matches SET `+strings.Join(sets, ", ")+` WHERE id = ?`, append(args, id)...)
+	return err
+}
+
+var (
+	errNoVod   = errors.New("not found")
+	errVodTeam = errors.New("VODs must belong to the match's team")
+)
+
+// assignVods puts VODs into a match, taking them out of any other one, and
+// fills in played_at from the earliest recording if the match has none.
+// Their offsets are cleared; callers run syncMatch after committing.
+func assignVods(tx *sql.Tx, matchID, teamID int64, vodIDs []int64) error {
+	for _, id := range vodIDs {
+		var vodTeam sql.NullInt64
+		err := tx.QueryRow(`SELECT team_id FROM vods WHERE id = ?`, id).Scan(&vodTeam)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("vod %d: %w", id, errNoVod)
+		} else if err != nil {
+			return err
+		}
+		if vodTeam.Int64 != teamID {
+			return fmt.Errorf("vod %d: %w", id, errVodTeam)
+		}
+		if _, err := tx.Exec(`UPDATE vods SET match_id = ?, match_offset = NULL, offset_source = NULL
+			WHERE id = ? AND COALESCE(match_id, 0) != ?1`, matchID, id); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(`UPDATE matches SET played_at = (SELECT MIN(COALESCE(media_created_at, recorded_at)) FROM vods WHERE match_id = ?1)
+		WHERE id = ?1 AND played_at IS NULL`, matchID)
+	return err
+}
+
+// assignError answers for a failed assignVods.
+func assignError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errVodTeam):
+		http.Error(w, err.Error(), 400)
+	case errors.Is(err, errNoVod):
+		http.Error(w, err.Error(), 404)
+	default:
+		log.Println("Assign VODs error:", err)
+		http.Error(w, "db error", 500)
+	}
+}
+
+// ----------------------- MATCH ENDPOINTS -----------------------
+
+// matches serves /api/matches and everything under it:
+//
+//	GET, POST           /api/matches
+//	POST                /api/matches/auto-group
+//	GET, PATCH, DELETE  /api/matches/{id}
+//	POST                /api/matches/{id}/vods
+//	PATCH, DELETE       /api/matches/{id}/vods/{vod_id}
+//	POST                /api/matches/{id}/sync
+//	GET                 /api/matches/{id}/timeline
+//	GET, POST           /api/matches/{id}/notes
+//	DELETE              /api/matches/{id}/notes/{note_id}
+//
+// Reading needs vods:read (notes:read for notes and the timeline) on the
+// match's team; everything else needs notes:write there.
+func (s *Server) matches(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/matches"), "/")
+	if rest == "" {
+		switch r.Method {
+		case http.MethodGet:
+			s.listMatches(w, r)
+		case http.MethodPost:
+			s.createMatch(w, r)
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+		return
+	}
+	if rest == "auto-group" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", 405)
+			return
+		}
+		s.autoGroup(w, r)
+		return
+	}
+
+	parts := strings.Split(rest, "/")
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) > 3 {
+		http.NotFound(w, r)
+		return
+	}
+	var sub int64
+	if len(parts) == 3 {
+		if sub, err = strconv.ParseInt(parts[2], 10, 64); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	perm := "notes:write"
+	if r.Method == http.MethodGet {
+		perm = "vods:read"
+		if len(parts) > 1 {
+			perm = "notes:read"
+		}
+	}
+	m, err := s.match(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "match not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if !s.requireTeam(w, r, perm, m.TeamID) {
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		s.matchDetail(w, m)
+	case len(parts) == 1 && r.Method == http.MethodPatch:
+		s.updateMatch(w, r, m)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		s.deleteMatch(w, r, m)
+	case len(parts) == 1:
+		http.Error(w, "method not allowed", 405)
+	case parts[1] == "vods" && len(parts) == 2 && r.Method == http.MethodPost:
+		s.addMatchVods(w, r, m)
+	case parts[1] == "vods" && len(parts) == 3 && r.Method == http.MethodPatch:
+		s.setVodOffset(w, r, m, sub)
+	case parts[1] == "vods" && len(parts) == 3 && r.Method == http.MethodDelete:
+		s.removeMatchVod(w, r, m, sub)
+	case parts[1] == "sync" && len(parts) == 2 && r.Method == http.MethodPost:
+		s.syncMatchHandler(w, r, m)
+	case parts[1] == "timeline" && len(parts) == 2 && r.Method == http.MethodGet:
+		s.matchTimeline(w, r, m)
+	case parts[1] == "notes" && len(parts) == 2 && r.Method == http.MethodGet:
+		s.listMatchNotes(w, m)
+	case parts[1] == "notes" && len(parts) == 2 && r.Method == http.MethodPost:
+		s.addMatchNote(w, r, m)
+	case parts[1] == "notes" && len(parts) == 3 && r.Method == http.MethodDelete:
+		s.deleteMatchNote(w, r, m, sub)
+	case len(parts) == 2 && (parts[1] == "sync" || parts[1] == "timeline"), parts[1] == "vods" || parts[1] == "notes":
+		http.Error(w, "method not allowed", 405)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// listMatches serves GET /api/matches, newest first, filtered by ?team_id,
+// ?type, and ?from and ?to on played_at. Without teams:all only the
+// caller's teams are listed.
+func (s *Server) listMatches(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	where, args := []string{"1 = 1"}, []any{}
+	if v := q.Get("team_id"); v != "" {
+		teamID, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "bad team_id", 400)
+			return
+		}
+		if !s.requireTeam(w, r, "vods:read", teamID) {
+			return
+		}
+		where, args = append(where, "m.team_id = ?"), append(args, teamID)
+	} else if !s.can(r.Context(), "teams:all") {
+		userID, _ := userFrom(r.Context())
+		scope, scopeArgs := teamScope("m.team_id", userID)
+		where, args = append(where, scope), append(args, scopeArgs...)
+	}
+	if v := q.Get("type"); v != "" {
+		where, args = append(where, "m.type = ?"), append(args, v)
+	}
+	for param, op := range map[string]string{"from": ">=", "to": "<="} {
+		v := q.Get(param)
+		if v == "" {
+			continue
+		}
+		t, err := parseTime(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%s: %v", param, err), 400)
+			return
+		}
+		where, args = append(where, "m.played_at "+op+" ?"), append(args, t.UTC().Format(time.DateTime))
+	}
+	limit, offset := pageParams(r, 50, 500)
+
+	rows, err := s.db.Query(`SELECT `+matchColumns+` FROM matches m JOIN teams t ON t.id = m.team_id
+		WHERE `+strings.Join(where, " AND ")+` ORDER BY COALESCE(m.played_at, m.created_at) DESC, m.id DESC
+		LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer rows.Close()
+	matches := []Match{}
+	for rows.Next() {
+		m, err := scanMatch(rows)
+		if err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		matches = append(matches, m)
+	}
+	writeJSON(w, 200, map[string]any{"matches": matches, "limit": limit, "offset": offset})
+}
+
+// createMatch serves POST /api/matches with {"team_id", "type", "opponent",
+// "map", "played_at", "result", "score", "vod_ids"}. Only team_id is
+// required; type defaults to scrim, and played_at to the earliest
+// recording among vod_ids.
+func (s *Server) createMatch(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		TeamID int64 `json:"team_id"`
+		matchPatch
+		VodIDs []int64 `json:"vod_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	if body.Type == nil {
+		scrim := "scrim"
+		body.Type = &scrim
+	}
+	if err := body.validate(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	var team string
+	err := s.db.QueryRow(`SELECT name FROM teams WHERE id = ?`, body.TeamID).Scan(&team)
+	if err == sql.ErrNoRows {
+		http.Error(w, "team not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if !s.requireTeam(w, r, "notes:write", body.TeamID) {
+		return
+	}
+	userID, _ := userFrom(r.Context())
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`INSERT INTO matches (team_id, type, created_by) VALUES (?, ?, ?)`, body.TeamID, *body.Type, userID)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	id, _ := res.LastInsertId()
+	if err := body.apply(tx, id); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if err := assignVods(tx, id, body.TeamID, body.VodIDs); err != nil {
+		assignError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "commit error", 500)
+		return
+	}
+	s.syncAfterAssign(id)
+
+	m, err := s.match(id)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	fmt.Printf("🏁 Created %s match %d for %s (%d VODs)\n", m.Type, id, team, m.VodCount)
+	s.audit(r, "match.create", "match", id, nil, map[string]any{"match": m, "vod_ids": body.VodIDs})
+	writeJSON(w, 200, map[string]any{"ok": true, "match": m})
+}
+
+// matchDetail serves GET /api/matches/{id}: the match and its VODs in
+// recording order.
+func (s *Server) matchDetail(w http.ResponseWriter, m Match) {
+	vods, err := s.matchVods(`v.match_id = ?`, m.ID)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	writeJSON(w, 200, map[string]any{"match": m, "vods": vods})
+}
+
+func (s *Server) updateMatch(w http.ResponseWriter, r *http.Request, m Match) {
+	var body matchPatch
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	if err := body.validate(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer tx.Rollback()
+	if err := body.apply(tx, m.ID); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "commit error", 500)
+		return
+	}
+	after, err := s.match(m.ID)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	s.audit(r, "match.update", "match", m.ID, m, after)
+	writeJSON(w, 200, map[string]any{"ok": true, "match": after})
+}
+
+// deleteMatch removes a match and its notes. Its VODs stay, unassigned.
+func (s *Server) deleteMatch(w http.ResponseWriter, r *http.Request, m Match) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer tx.Rollback()
+	for _, stmt := range []string{
+		`UPDATE vods SET match_id = NULL, match_offset = NULL, offset_source = NULL WHERE match_id = ?`,
+		`DELETE FROM match_notes WHERE match_id = ?`,
+		`DELETE FROM matches WHERE id = ?`,
+	} {
+		if _, err := tx.Exec(stmt, m.ID); err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "commit error", 500)
+		return
+	}
+	s.audit(r, "match.delete", "match", m.ID, m, nil)
+	writeJSON(w, 200, map[string]any{"ok": true, "deleted": m.ID, "vods_unassigned": m.VodCount, "notes_deleted": m.NoteCount})
+}
+
+// addMatchVods serves POST /api/matches/{id}/vods with {"vod_ids": [4, 7]}.
+// A VOD already in another match moves to this one.
+func (s *Server) addMatchVods(w http.ResponseWriter, r *http.Request, m Match) {
+	var body struct {
+		VodIDs []int64 `json:"vod_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	if len(body.VodIDs) == 0 {
+		http.Error(w, "vod_ids required", 400)
+		return
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer tx.Rollback()
+	if err := assignVods(tx, m.ID, m.TeamID, body.VodIDs); err != nil {
+		assignError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "commit error", 500)
+		return
+	}
+	s.syncAfterAssign(m.ID)
+	s.audit(r, "match.assign", "match", m.ID, nil, map[string]any{"vod_ids": body.VodIDs})
+	after, err := s.match(m.ID)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	s.matchDetail(w, after)
+}
+
+func (s *Server) removeMatchVod(w http.ResponseWriter, r *http.Request, m Match, vodID int64) {
+	res, err := s.db.Exec(`UPDATE vods SET match_id = NULL, match_offset = NULL, offset_source = NULL
+		WHERE id = ? AND match_id = ?`, vodID, m.ID)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "vod not in this match", 404)
+		return
+	}
+	s.syncAfterAssign(m.ID)
+	s.audit(r, "match.unassign", "match", m.ID, map[string]any{"vod_id": vodID}, nil)
+	writeJSON(w, 200, map[string]any{"ok": true, "vod_id": vodID})
+}
+
+// ----------------------- MATCH NOTES -----------------------
+
+type matchNote struct {
+	ID        int64   `json:"id"`
+	UserID    int64   `json:"user_id"`
+	Author    string  `json:"author"`
+	TsSeconds float64 `json:"ts_seconds"`
+	Content   string  `json:"content"`
+	CreatedAt string  `json:"created_at"`
+}
+
+// matchNotes lists a match's notes in match time order.
+func (s *Server) matchNotes(matchID int64) ([]matchNote, error) {
+	rows, err := s.db.Query(`SELECT n.id, n.user_id, COALESCE(NULLIF(u.display_name, ''), u.username, ''),
+		n.ts_seconds, n.content, COALESCE(n.created_at, '')
+		FROM match_notes n LEFT JOIN users u ON u.id = n.user_id
+		WHERE n.match_id = ? ORDER BY n.ts_seconds, n.id`, matchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	notes := []matchNote{}
+	for rows.Next() {
+		var n matchNote
+		if err := rows.Scan(&n.ID, &n.UserID, &n.Author, &n.TsSeconds, &n.Content, &n.CreatedAt); err != nil {
+			return nil, err
+		}
+		notes = append(notes, n)
+	}
+	return notes, rows.Err()
+}
+
+// listMatchNotes serves GET /api/matches/{id}/notes. ts_seconds is match
+// time; the timeline maps it onto each POV.
+func (s *Server) listMatchNotes(w http.ResponseWriter, m Match) {
+	notes, err := s.matchNotes(m.ID)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	writeJSON(w, 200, map[string]any{"match_id": m.ID, "notes": notes})
+}
+
+// addMatchNote serves POST /api/matches/{id}/notes with {"ts_seconds",
+// "content"}, ts_seconds in match time.
+func (s *Server) addMatchNote(w http.ResponseWriter, r *http.Request, m Match) {
+	var body struct {
+		TsSeconds float64 `json:"ts_seconds"`
+		Content   string  `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	if strings.TrimSpace(body.Content) == "" {
+		http.Error(w, "empty note", 400)
+		return
+	}
+	userID, _ := userFrom(r.Context())
+	res, err := s.db.Exec(`INSERT INTO match_notes (match_id, user_id, ts_seconds, content) VALUES (?, ?, ?, ?)`,
+		m.ID, userID, body.TsSeconds, body.Content)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	noteID, _ := res.LastInsertId()
+	s.audit(r, "match_note.create", "match", m.ID, nil, map[string]any{"note_id": noteID, "ts_seconds": body.TsSeconds})
+	writeJSON(w, 200, map[string]any{"ok": true, "id": noteID})
+}
+
+// deleteMatchNote removes one of the caller's own match notes.
+func (s *Server) deleteMatchNote(w http.ResponseWriter, r *http.Request, m Match, noteID int64) {
+	userID, _ := userFrom(r.Context())
+	var author int64
+	err := s.db.QueryRow(`SELECT user_id FROM match_notes WHERE id = ? AND match_id = ?`, noteID, m.ID).Scan(&author)
+	if err == sql.ErrNoRows {
+		http.Error(w, "note not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if author != userID {
+		http.Error(w, "you can only delete your own notes", 403)
+		return
+	}
+	if _, err := s.db.Exec(`DELETE FROM match_notes WHERE id = ?`, noteID); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	s.audit(r, "match_note.delete", "match", m.ID, map[string]any{"note_id": noteID}, nil)
+	writeJSON(w, 200, map[string]any{"ok": true, "deleted": noteID})
+}
+
+// ----------------------- AUTO-GROUPING -----------------------
+
+type proposedMatch struct {
+	ID       int64      `json:"id,omitempty"`
+	PlayedAt string     `json:"played_at"`
+	Vods     []matchVod `json:"vods"`
+}
+
+// groupVods clusters VODs sorted by their start time. A cluster takes VODs
+// that started within window of its first one, one per player; a second
+// VOD from the same player starts the next cluster. Clusters of a single
+// VOD are dropped.
+func groupVods(vods []matchVod, window time.Duration) []proposedMatch {
+	var groups []proposedMatch
+	var cur []matchVod
+	var start time.Time
+	flush := func() {
+		if len(cur) > 1 {
+			groups = append(groups, proposedMatch{PlayedAt: cur[0].StartedAt, Vods: cur})
+		}
+		cur = nil
+	}
+	for _, v := range vods {
+		t, err := time.Parse(time.DateTime, v.StartedAt)
+		if err != nil {
+			continue
+		}
+		samePlayer := slices.ContainsFunc(cur, func(c matchVod) bool { return c.PlayerID == v.PlayerID })
+		if len(cur) > 0 && (t.Sub(start) > window || samePlayer) {
+			flush()
+		}
+		if len(cur) == 0 {
+			start = t
+		}
+		cur = append(cur, v)
+	}
+	flush()
+	return groups
+}
+
+// autoGroup serves POST /api/matches/auto-group with {"team_id": 2,
+// "window_minutes": 10, "type": "scrim", "dry_run": true}. It groups the
+// team's VODs that aren't in a match yet by recording start time and, unless
+// dry_run is set, creates a match for each group.
+func (s *Server) autoGroup(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		TeamID        int64  `json:"team_id"`
+		WindowMinutes int    `json:"window_minutes"`
+		Type          string `json:"type"`
+		DryRun        bool   `json:"dry_run"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	if body.WindowMinutes == 0 {
+		body.WindowMinutes = defaultGroupWindow
+	}
+	if body.WindowMinutes < 1 || body.WindowMinutes > maxGroupWindow {
+		http.Error(w, fmt.Sprintf("window_minutes must be between 1 and %d", maxGroupWindow), 400)
+		return
+	}
+	if body.Type == "" {
+		body.Type = "scrim"
+	}
+	if !slices.Contains(matchTypes, body.Type) {
+		http.Error(w, fmt.Sprintf("type must be one of %s", strings.Join(matchTypes, ", ")), 400)
+		return
+	}
+	var team string
+	err := s.db.QueryRow(`SELECT name FROM teams WHERE id = ?`, body.TeamID).Scan(&team)
+	if err == sql.ErrNoRows {
+		http.Error(w, "team not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if !s.requireTeam(w, r, "notes:write", body.TeamID) {
+		return
+	}
+
+	vods, err := s.matchVods(`v.team_id = ? AND v.match_id IS NULL
+		AND COALESCE(v.media_created_at, v.recorded_at) IS NOT NULL`, body.TeamID)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	groups := groupVods(vods, time.Duration(body.WindowMinutes)*time.Minute)
+	grouped := 0
+	for _, g := range groups {
+		grouped += len(g.Vods)
+	}
+	if groups == nil {
+		groups = []proposedMatch{}
+	}
+	if body.DryRun || len(groups) == 0 {
+		writeJSON(w, 200, map[string]any{"dry_run": body.DryRun, "matches": groups, "ungrouped": len(vods) - grouped})
+		return
+	}
+
+	userID, _ := userFrom(r.Context())
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer tx.Rollback()
+	ids := []int64{}
+	for i, g := range groups {
+		res, err := tx.Exec(`INSERT INTO matches (team_id, type, played_at, created_by) VALUES (?, ?, ?, ?)`,
+			body.TeamID, body.Type, g.PlayedAt, userID)
+		if err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		groups[i].ID, _ = res.LastInsertId()
+		ids = append(ids, groups[i].ID)
+		for _, v := range g.Vods {
+			if _, err := tx.Exec(`UPDATE vods SET match_id = ? WHERE id = ?`, groups[i].ID, v.ID); err != nil {
+				http.Error(w, "db error", 500)
+				return
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "commit error", 500)
+		return
+	}
+	for _, id := range ids {
+		s.syncAfterAssign(id)
+	}
+	fmt.Printf("🏁 Grouped %d VODs of %s into %d matches\n", grouped, team, len(groups))
+	s.audit(r, "match.auto_group", "team", body.TeamID, nil, map[string]any{
+		"match_ids": ids, "vods": grouped, "window_minutes": body.WindowMinutes, "type": body.Type,
+	})
+	writeJSON(w, 200, map[string]any{"dry_run": false, "matches": groups, "ungrouped": len(vods) - grouped})
+}
+
+// vodRecordedAt is recorded_at for an uploaded file: ?recorded_at if the
+// client sent one, else the filename's timestamp.
+func vodRecordedAt(r *http.Request, filename string) (any, error) {
+	if v := r.URL.Query().Get("recorded_at"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			return nil, fmt.Errorf("recorded_at: %v", err)
+		}
+		return t.UTC().Format(time.DateTime), nil
+	}
+	return recordedAt(path.Base(filename), time.Time{}), nil
+}
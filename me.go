@@ -0,0 +1,235 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// ----------------------- MY ACCOUNT -----------------------
+
+// A user can be linked to player profiles through players.user_id, one for
+// each team they play in. Admins set the link with
+// /api/admin/players/{id}/link, or an invite made out to a player links the
+// account that accepts it. Notes other people write on a linked player's
+// VODs count as feedback. note_reads remembers the newest note the player
+// has seen on each of their VODs, so unread feedback is anything after it.
+
+type myTeam struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// me serves GET /api/me: who the caller is, what they may do, their teams
+// and the player profiles linked to them.
+func (s *Server) me(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", 405)
+		return
+	}
+	userID, role := userFrom(r.Context())
+	var username, displayName string
+	err := s.db.QueryRow(`SELECT username, COALESCE(display_name, '') FROM users WHERE id = ?`, userID).
+		Scan(&username, &displayName)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+
+	teams := []myTeam{}
+	rows, err := s.db.Query(`SELECT t.id, t.name, COALESCE(m.role, ?) FROM memberships m
+		JOIN teams t ON t.id = m.team_id WHERE m.user_id = ? ORDER BY t.name`, role, userID)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	for rows.Next() {
+		var t myTeam
+		if err := rows.Scan(&t.ID, &t.Name, &t.Role); err != nil {
+			rows.Close()
+			http.Error(w, "db error", 500)
+			return
+		}
+		teams = append(teams, t)
+	}
+	rows.Close()
+
+	players, err := s.linkedPlayers(userID)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	var unread int
+	if err := s.db.QueryRow(`SELECT COALESCE(SUM(unread), 0) FROM (`+myVodsQuery+`)`,
+		userID, userID, userID, userID).Scan(&unread); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+
+	writeJSON(w, 200, map[string]any{
+		"id":              userID,
+		"username":        username,
+		"display_name":    displayName,
+		"role":            role,
+		"permissions":     s.roleSummary(role)["permissions"],
+		"all_teams":       s.can(r.Context(), "teams:all"),
+		"teams":           teams,
+		"players":         players,
+		"unread_feedback": unread,
+	})
+}
+
+func (s *Server) linkedPlayers(userID int64) ([]playerRef, error) {
+	rows, err := s.db.Query(`SELECT p.id, p.name, t.id, t.name FROM players p JOIN teams t ON t.id = p.team_id
+		WHERE p.user_id = ? ORDER BY t.name, p.name`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	players := []playerRef{}
+	for rows.Next() {
+		var p playerRef
+		if err := rows.Scan(&p.ID, &p.Name, &p.TeamID, &p.Team); err != nil {
+			return nil, err
+		}
+		players = append(players, p)
+	}
+	return players, rows.Err()
+}
+
+// myVodsQuery lists the VODs of the player profiles linked to a user, with
+// how many notes others wrote on each and how many of those are unread. It
+// takes the user id four times.
+const myVodsQuery = `SELECT v.id AS id, v.file_path, COALESCE(v.title, ''), COALESCE(v.created_at, ''),
+	v.archived_at IS NOT NULL, p.id, p.name, t.name,
+	(SELECT COUNT(*) FROM notes n WHERE n.vod_id = v.id AND n.user_id != ?) AS feedback,
+	(SELECT COUNT(*) FROM notes n WHERE n.vod_id = v.id AND n.user_id != ? AND n.id >
+		COALESCE((SELECT last_note_id FROM note_reads nr WHERE nr.user_id = ? AND nr.vod_id = v.id), 0)) AS unread
+	FROM vods v JOIN players p ON p.id = v.player_id JOIN teams t ON t.id = v.team_id
+	WHERE p.user_id = ?`
+
+type myVod struct {
+	ID             int64  `json:"id"`
+	FilePath       string `json:"file_path"`
+	Title          string `json:"title"`
+	CreatedAt      string `json:"created_at"`
+	Archived       bool   `json:"archived"`
+	PlayerID       int64  `json:"player_id"`
+	Player         string `json:"player"`
+	Team           string `json:"team"`
+	Feedback       int    `json:"feedback"`
+	UnreadFeedback int    `json:"unread_feedback"`
+}
+
+// myVods serves GET /api/me/vods, newest first. ?unread=true keeps only
+// VODs with feedback the caller hasn't seen. Fetching a VOD's notes marks
+// its feedback read.
+func (s *Server) myVods(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", 405)
+		return
+	}
+	userID, _ := userFrom(r.Context())
+	limit, offset := pageParams(r, 50, 500)
+	where := ""
+	if r.URL.Query().Get("unread") == "true" {
+		where = ` WHERE unread > 0`
+	}
+
+	rows, err := s.db.Query(`SELECT * FROM (`+myVodsQuery+`)`+where+` ORDER BY id DESC LIMIT ? OFFSET ?`,
+		userID, userID, userID, userID, limit, offset)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer rows.Close()
+	vods := []myVod{}
+	for rows.Next() {
+		var v myVod
+		if err := rows.Scan(&v.ID, &v.FilePath, &v.Title, &v.CreatedAt, &v.Archived,
+			&v.PlayerID, &v.Player, &v.Team, &v.Feedback, &v.UnreadFeedback); err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		vods = append(vods, v)
+	}
+	writeJSON(w, 200, map[string]any{"vods": vods, "limit": limit, "offset": offset})
+}
+
+// markNotesRead records that userID has seen every note on vodID so far.
+// It only does anything when the VOD belongs to a player linked to them.
+func (s *Server) markNotesRead(userID int64, vodID any) error {
+	_, err := s.db.Exec(`INSERT INTO note_reads (user_id, vod_id, last_note_id)
+		SELECT ?, v.id, COALESCE((SELECT MAX(id) FROM notes WHERE vod_id = v.id), 0)
+		FROM vods v JOIN players p ON p.id = v.player_id WHERE v.id = ? AND p.user_id = ?
+		ON CONFLICT (user_id, vod_id) DO UPDATE SET last_note_id = excluded.last_note_id, read_at = CURRENT_TIMESTAMP`,
+		userID, vodID, userID)
+	return err
+}
+
+// ----------------------- PLAYER LINKS -----------------------
+
+// linkPlayer serves POST /api/admin/players/{id}/link with {"user_id": 5},
+// or null to unlink. Linking also makes the user a member of the player's
+// team, so they can open their own VODs.
+func (s *Server) linkPlayer(w http.ResponseWriter, r *http.Request, p playerRef) {
+	var body struct {
+		UserID *int64 `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	var before any
+	var current sql.NullInt64
+	if err := s.db.QueryRow(`SELECT user_id FROM players WHERE id = ?`, p.ID).Scan(&current); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if current.Valid {
+		before = map[string]any{"user_id": current.Int64}
+	}
+
+	if body.UserID == nil || *body.UserID == 0 {
+		if _, err := s.db.Exec(`UPDATE players SET user_id = NULL WHERE id = ?`, p.ID); err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		s.audit(r, "player.unlink", "player", p.ID, before, nil)
+		writeJSON(w, 200, map[string]any{"ok": true, "player": p, "user_id": nil})
+		return
+	}
+
+	var username string
+	err := s.db.QueryRow(`SELECT username FROM users WHERE id = ?`, *body.UserID).Scan(&username)
+	if err == sql.ErrNoRows {
+		http.Error(w, "user not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE players SET user_id = ? WHERE id = ?`, *body.UserID, p.ID); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if _, err := tx.Exec(`INSERT OR IGNORE INTO memberships (user_id, team_id) VALUES (?, ?)`, *body.UserID, p.TeamID); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "commit error", 500)
+		return
+	}
+	fmt.Printf("🔗 Linked player %s/%s to %s\n", p.Team, p.Name, username)
+	s.audit(r, "player.link", "player", p.ID, before, map[string]any{"user_id": *body.UserID, "username": username})
+	writeJSON(w, 200, map[string]any{"ok": true, "player": p, "user_id": *body.UserID, "username": username})
+}
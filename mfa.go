@@ -0,0 +1,465 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ----------------------- TOTP (RFC 6238) -----------------------
+
+const (
+	totpStep   = 30 * time.Second
+	totpDigits = 6
+	// totpSkew accepts codes from one step either side, for clock drift.
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return b32.EncodeToString(b)
+}
+
+// totpCode is the RFC 4226 HOTP value for one time step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, v%1000000)
+}
+
+// checkTOTP returns the time step a code matches, or -1. Steps at or before
+// lastStep are refused so a code can't be replayed.
+func checkTOTP(secret, code string, lastStep int64, now time.Time) int64 {
+	key, err := b32.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return -1
+	}
+	cur := now.Unix() / int64(totpStep/time.Second)
+	for d := int64(-totpSkew); d <= totpSkew; d++ {
+		step := cur + d
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return -1
+}
+
+func otpauthURI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(int(totpStep/time.Second)))
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// ----------------------- RECOVERY CODES -----------------------
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// newRecoveryCodes replaces a user's recovery codes and returns the new ones.
+// Only their hashes are stored.
+func (s *Server) newRecoveryCodes(tx *sql.Tx, userID int64) ([]string, error) {
+	if _, err := tx.Exec(`DELETE FROM mfa_recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		rand.Read(b)
+		c := strings.ToLower(b32.EncodeToString(b))
+		codes[i] = c[:4] + "-" + c[4:]
+		if _, err := tx.Exec(`INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES (?, ?)`,
+			userID, hashSecret(normalizeRecoveryCode(c))); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused
+// recovery code, which is then used up.
+func (s *Server) verifySecondFactor(userID int64, code string) (bool, error) {
+	var secret sql.NullString
+	var lastStep int64
+	err := s.db.QueryRow(`SELECT totp_secret, COALESCE(totp_last_step, 0) FROM users
+		WHERE id = ? AND totp_enabled_at IS NOT NULL`, userID).Scan(&secret, &lastStep)
+	if err != nil {
+		return false, err
+	}
+
+	code = strings.TrimSpace(code)
+	if step := checkTOTP(secret.String, code, lastStep, time.Now()); step >= 0 {
+		// The WHERE makes two concurrent uses of one code race safely.
+		res, err := s.db.Exec(`UPDATE users SET totp_last_step = ? WHERE id = ? AND COALESCE(totp_last_step, 0) < ?`,
+			step, userID, step)
+		if err != nil {
+			return false, err
+		}
+		n, _ := res.RowsAffected()
+		return n == 1, nil
+	}
+
+	res, err := s.db.Exec(`UPDATE mfa_recovery_codes SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL`, userID, hashSecret(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// mfaRequiredFor reports whether 2FA is mandatory for a role: mfaRequired
+// is on in config and the role is marked mfa_required.
+func (s *Server) mfaRequiredFor(role string) bool {
+	return s.cfg.MFARequired && s.roleRequiresMFA(role)
+}
+
+// mfaEnrollPaths are all a session may use while its user still has to set
+// up mandatory 2FA.
+var mfaEnrollPaths = map[string]bool{
+	"/api/auth/mfa":         true,
+	"/api/auth/mfa/enroll":  true,
+	"/api/auth/mfa/confirm": true,
+	"/api/auth/logout":      true,
+}
+
+// ----------------------- LOGIN SECOND STEP -----------------------
+
+// loginMFA finishes a login that returned mfa_required, given the mfa_token
+// from that response and a TOTP or recovery code.
+func (s *Server) loginMFA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", 405)
+		return
+	}
+	var body struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	userID, err := s.parseMFAToken(body.MFAToken)
+	if err != nil {
+		http.Error(w, "login expired, start again", 401)
+		return
+	}
+
+	u := sessionUser{ID: userID}
+	var disabled bool
+	err = s.db.QueryRow(`SELECT username, role, must_change_password, totp_enabled_at IS NOT NULL,
+		disabled_at IS NOT NULL FROM users WHERE id = ?`,
+		userID).Scan(&u.Username, &u.Role, &u.MustChangePassword, &u.MFAEnabled, &disabled)
+	if err != nil || disabled {
+		http.Error(w, "login expired, start again", 401)
+		return
+	}
+
+	attempt, wait, err := s.beginLogin(r, u.Username)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if wait > 0 {
+		retryAfter(w, wait)
+		return
+	}
+	defer s.endLogin(attempt, false, "error")
+	ok, err := s.verifySecondFactor(userID, body.Code)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if !ok {
+		s.endLogin(attempt, false, "bad_mfa_code")
+		http.Error(w, "invalid code", 401)
+		return
+	}
+	s.endLogin(attempt, true, "")
+	s.startSession(w, r, u)
+}
+
+// ----------------------- ENROLLMENT ENDPOINTS -----------------------
+
+// mfaStatus reports whether 2FA is on for the caller and how many recovery
+// codes they have left.
+func (s *Server) mfaStatus(w http.ResponseWriter, r *http.Request) {
+	userID, role := userFrom(r.Context())
+	var enabled bool
+	var left int
+	err := s.db.QueryRow(`SELECT totp_enabled_at IS NOT NULL,
+		(SELECT COUNT(*) FROM mfa_recovery_codes WHERE user_id = users.id AND used_at IS NULL)
+		FROM users WHERE id = ?`, userID).Scan(&enabled, &left)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	writeJSON(w, 200, map[string]any{
+		"enabled":             enabled,
+		"required":            s.mfaRequiredFor(role),
+		"recovery_codes_left": left,
+	})
+}
+
+// enrollMFA starts enrollment with a fresh secret. 2FA is only switched on
+// once confirmMFA sees a valid code from it.
+func (s *Server) enrollMFA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", 405)
+		return
+	}
+	userID, _ := userFrom(r.Context())
+	var username string
+	var enabled bool
+	if err := s.db.QueryRow(`SELECT username, totp_enabled_at IS NOT NULL FROM users WHERE id = ?`, userID).
+		Scan(&username, &enabled); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if enabled {
+		http.Error(w, "two-factor authentication is already on", 409)
+		return
+	}
+	secret := newTOTPSecret()
+	if _, err := s.db.Exec(`UPDATE users SET totp_secret = ?, totp_last_step = 0 WHERE id = ?`, secret, userID); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	s.audit(r, "mfa.enroll", "user", userID, nil, nil)
+	writeJSON(w, 200, map[string]any{
+		"secret":      secret,
+		"otpauth_uri": otpauthURI(s.cfg.AppName, username, secret),
+	})
+}
+
+// confirmMFA switches 2FA on and hands out recovery codes, which are only
+// ever shown this once.
+func (s *Server) confirmMFA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", 405)
+		return
+	}
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	userID, _ := userFrom(r.Context())
+
+	var secret sql.NullString
+	var enabled bool
+	if err := s.db.QueryRow(`SELECT totp_secret, totp_enabled_at IS NOT NULL FROM users WHERE id = ?`, userID).
+		Scan(&secret, &enabled); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if enabled {
+		http.Error(w, "two-factor authentication is already on", 409)
+		return
+	}
+	if !secret.Valid {
+		http.Error(w, "start enrollment first", 409)
+		return
+	}
+	step := checkTOTP(secret.String, strings.TrimSpace(body.Code), 0, time.Now())
+	if step < 0 {
+		http.Error(w, "invalid code", 400)
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE users SET totp_enabled_at = CURRENT_TIMESTAMP, totp_last_step = ? WHERE id = ?`,
+		step, userID); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	codes, err := s.newRecoveryCodes(tx, userID)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "commit error", 500)
+		return
+	}
+	s.audit(r, "mfa.enable", "user", userID, map[string]any{"mfa": false}, map[string]any{"mfa": true})
+	writeJSON(w, 200, map[string]any{"ok": true, "recovery_codes": codes})
+}
+
+// regenerateRecoveryCodes replaces all recovery codes, given a current code.
+func (s *Server) regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", 405)
+		return
+	}
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	userID, _ := userFrom(r.Context())
+	ok, err := s.verifySecondFactor(userID, body.Code)
+	if err == sql.ErrNoRows {
+		http.Error(w, "two-factor authentication is off", 409)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if !ok {
+		http.Error(w, "invalid code", 400)
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer tx.Rollback()
+	codes, err := s.newRecoveryCodes(tx, userID)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "commit error", 500)
+		return
+	}
+	s.audit(r, "mfa.recovery_codes", "user", userID, nil, map[string]any{"codes": len(codes)})
+	writeJSON(w, 200, map[string]any{"ok": true, "recovery_codes": codes})
+}
+
+// disableMFA turns 2FA off, given the password and a current code. Roles
+// that must use 2FA can't turn it off.
+func (s *Server) disableMFA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", 405)
+		return
+	}
+	var body struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	userID, role := userFrom(r.Context())
+	if s.mfaRequiredFor(role) {
+		http.Error(w, "two-factor authentication is required for your role", 403)
+		return
+	}
+
+	var hash string
+	if err := s.db.QueryRow(`SELECT password_hash FROM users WHERE id = ?`, userID).Scan(&hash); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(body.Password)) != nil {
+		http.Error(w, "wrong password", 403)
+		return
+	}
+	ok, err := s.verifySecondFactor(userID, body.Code)
+	if err == sql.ErrNoRows {
+		http.Error(w, "two-factor authentication is off", 409)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if !ok {
+		http.Error(w, "invalid code", 400)
+		return
+	}
+	if err := s.clearMFA(userID); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	s.audit(r, "mfa.disable", "user", userID, map[string]any{"mfa": true}, map[string]any{"mfa": false})
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
+
+func (s *Server) clearMFA(userID int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = NULL
+		WHERE id = ?`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM mfa_recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// adminResetMFA is for a user who lost both their device and recovery codes.
+// It turns their 2FA off and signs them out; if 2FA is mandatory for their
+// role they'll have to enroll again on next login.
+func (s *Server) adminResetMFA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", 405)
+		return
+	}
+	var body struct {
+		UserID int64 `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.UserID == 0 {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	if !s.mayManageUser(w, r, body.UserID) {
+		return
+	}
+	if err := s.clearMFA(body.UserID); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	n, _ := s.revokeSessions(body.UserID, 0)
+	s.audit(r, "mfa.reset", "user", body.UserID, nil, map[string]any{"mfa": false, "sessions_revoked": n})
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ----------------------- MIGRATIONS -----------------------
+
+// setup.exe creates the base tables (users, teams, players, memberships,
+// vods, notes). Everything added since then is created here on startup, so
+// existing databases pick it up without re-running setup. Every statement
+// must be safe to run more than once.
+var schemaMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS jobs (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  type TEXT NOT NULL,
+  payload TEXT NOT NULL DEFAULT '{}',
+  dedupe_key TEXT,
+  status TEXT NOT NULL DEFAULT 'queued' CHECK (status IN ('queued','running','succeeded','failed','cancelled')),
+  attempts INTEGER NOT NULL DEFAULT 0,
+  max_attempts INTEGER NOT NULL DEFAULT 3,
+  run_at INTEGER NOT NULL,
+  last_error TEXT,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  started_at DATETIME,
+  finished_at DATETIME
+)`,
+	`CREATE INDEX IF NOT EXISTS jobs_status_run_at ON jobs(status, run_at)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS jobs_active_key ON jobs(dedupe_key) WHERE status IN ('queued','running')`,
+	`CREATE TABLE IF NOT EXISTS sessions (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL,
+  refresh_hash TEXT NOT NULL UNIQUE,
+  prev_refresh_hash TEXT,
+  rotated_at INTEGER,
+  user_agent TEXT,
+  ip TEXT,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  last_used_at DATETIME,
+  expires_at INTEGER NOT NULL,
+  revoked_at DATETIME
+)`,
+	`CREATE INDEX IF NOT EXISTS sessions_user ON sessions(user_id)`,
+	`CREATE INDEX IF NOT EXISTS sessions_prev_hash ON sessions(prev_refresh_hash)`,
+	`CREATE TABLE IF NOT EXISTS password_resets (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL,
+  token_hash TEXT NOT NULL UNIQUE,
+  created_by INTEGER,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  expires_at INTEGER NOT NULL,
+  used_at DATETIME
+)`,
+	`CREATE TABLE IF NOT EXISTS login_attempts (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  username TEXT NOT NULL,
+  ip TEXT,
+  user_agent TEXT,
+  success INTEGER NOT NULL,
+  reason TEXT,
+  at INTEGER NOT NULL
+)`,
+	`CREATE INDEX IF NOT EXISTS login_attempts_username ON login_attempts(username, id)`,
+	`CREATE INDEX IF NOT EXISTS login_attempts_ip ON login_attempts(ip, id)`,
+	`CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL,
+  code_hash TEXT NOT NULL,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  used_at DATETIME
+)`,
+	`CREATE INDEX IF NOT EXISTS mfa_recovery_codes_user ON mfa_recovery_codes(user_id)`,
+	`CREATE TABLE IF NOT EXISTS invites (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  token_hash TEXT NOT NULL UNIQUE,
+  team_id INTEGER NOT NULL,
+  role TEXT NOT NULL,
+  max_uses INTEGER NOT NULL,
+  uses INTEGER NOT NULL DEFAULT 0,
+  created_by INTEGER,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  expires_at INTEGER NOT NULL,
+  revoked_at DATETIME
+)`,
+	`CREATE TABLE IF NOT EXISTS api_keys (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name TEXT NOT NULL,
+  prefix TEXT NOT NULL,
+  key_hash TEXT NOT NULL UNIQUE,
+  user_id INTEGER NOT NULL,
+  scopes TEXT NOT NULL,
+  created_by INTEGER,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  expires_at INTEGER NOT NULL,
+  last_used_at INTEGER,
+  last_used_ip TEXT,
+  revoked_at DATETIME
+)`,
+	`CREATE TABLE IF NOT EXISTS roles (
+  name TEXT PRIMARY KEY,
+  description TEXT,
+  builtin INTEGER NOT NULL DEFAULT 0,
+  mfa_required INTEGER NOT NULL DEFAULT 0,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+)`,
+	`CREATE TABLE IF NOT EXISTS role_permissions (
+  role TEXT NOT NULL,
+  permission TEXT NOT NULL,
+  PRIMARY KEY (role, permission)
+)`,
+	`CREATE TABLE IF NOT EXISTS user_identities (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL,
+  issuer TEXT NOT NULL,
+  subject TEXT NOT NULL,
+  email TEXT,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  last_login_at DATETIME,
+  UNIQUE (issuer, subject)
+)`,
+	`CREATE TABLE IF NOT EXISTS oidc_states (
+  state_hash TEXT PRIMARY KEY,
+  nonce TEXT NOT NULL,
+  verifier TEXT NOT NULL,
+  expires_at INTEGER NOT NULL
+)`,
+	`CREATE TABLE IF NOT EXISTS sso_codes (
+  code_hash TEXT PRIMARY KEY,
+  user_id INTEGER NOT NULL,
+  expires_at INTEGER NOT NULL
+)`,
+	`CREATE TABLE IF NOT EXISTS audit_events (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  actor_id INTEGER,
+  actor TEXT,
+  api_key_id INTEGER,
+  action TEXT NOT NULL,
+  target_type TEXT NOT NULL,
+  target_id TEXT,
+  ip TEXT,
+  before TEXT,
+  after TEXT
+)`,
+	`CREATE TRIGGER IF NOT EXISTS audit_events_no_update BEFORE UPDATE ON audit_events
+BEGIN SELECT RAISE(ABORT, 'audit_events is append-only'); END`,
+	`CREATE TRIGGER IF NOT EXISTS audit_events_no_delete BEFORE DELETE ON audit_events
+BEGIN SELECT RAISE(ABORT, 'audit_events is append-only'); END`,
+	`CREATE TABLE IF NOT EXISTS note_reads (
+  user_id INTEGER NOT NULL,
+  vod_id INTEGER NOT NULL,
+  last_note_id INTEGER NOT NULL,
+  read_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (user_id, vod_id)
+)`,
+	`CREATE TABLE IF NOT EXISTS roster_history (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  player_id INTEGER NOT NULL,
+  team_id INTEGER NOT NULL,
+  joined_at DATE NOT NULL,
+  left_at DATE
+)`,
+	`CREATE TABLE IF NOT EXISTS matches (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  team_id INTEGER NOT NULL,
+  type TEXT NOT NULL,
+  opponent TEXT,
+  map TEXT,
+  played_at DATETIME,
+  result TEXT,
+  score TEXT,
+  created_by INTEGER,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+)`,
+	`CREATE TABLE IF NOT EXISTS match_notes (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  match_id INTEGER NOT NULL,
+  user_id INTEGER NOT NULL,
+  ts_seconds REAL NOT NULL,
+  content TEXT NOT NULL,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+)`,
+	`CREATE TABLE IF NOT EXISTS vod_tags (
+  vod_id INTEGER NOT NULL,
+  tag TEXT NOT NULL,
+  PRIMARY KEY (vod_id, tag)
+)`,
+}
+
+// columnMigrations add columns to existing tables, skipping those already there.
+var columnMigrations = []struct {
+	table, column, decl string
+}{
+	{"vods", "content_hash", "TEXT"},
+	{"vods", "hash_size", "INTEGER"},
+	{"vods", "hash_mtime", "INTEGER"},
+	{"vods", "size_bytes", "INTEGER"},
+	{"teams", "quota_bytes", "INTEGER"},
+	{"vods", "archived_at", "DATETIME"},
+	{"users", "must_change_password", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "password_changed_at", "DATETIME"},
+	{"users", "disabled_at", "DATETIME"},
+	{"users", "totp_secret", "TEXT"},
+	{"users", "totp_enabled_at", "DATETIME"},
+	{"users", "totp_last_step", "INTEGER"},
+	{"users", "invite_id", "INTEGER"},
+	{"memberships", "role", "TEXT"},
+	{"players", "user_id", "INTEGER"},
+	{"invites", "player_id", "INTEGER"},
+	{"players", "ign", "TEXT"},
+	{"players", "game_role", "TEXT"},
+	{"players", "mains", "TEXT"},
+	{"players", "region", "TEXT"},
+	{"players", "status", "TEXT NOT NULL DEFAULT 'active'"},
+	{"vods", "team_id", "INTEGER"},
+	{"vods", "match_id", "INTEGER"},
+	{"vods", "recorded_at", "DATETIME"},
+	{"vods", "match_offset", "REAL"},
+	{"vods", "offset_source", "TEXT"},
+	{"vods", "media_created_at", "DATETIME"},
+	{"vods", "duration_seconds", "REAL"},
+	{"vods", "probe_size", "INTEGER"},
+	{"matches", "clock_start", "DATETIME"},
+	{"vods", "description", "TEXT"},
+	{"vods", "game", "TEXT"},
+	{"vods", "map", "TEXT"},
+	{"vods", "patch", "TEXT"},
+	{"vods", "opponent", "TEXT"},
+}
+
+// indexMigrations run last, since they may cover columns added above.
+var indexMigrations = []string{
+	`CREATE INDEX IF NOT EXISTS vods_content_hash ON vods(content_hash)`,
+	`CREATE INDEX IF NOT EXISTS audit_events_actor ON audit_events(actor_id)`,
+	`CREATE INDEX IF NOT EXISTS audit_events_target ON audit_events(target_type, target_id)`,
+	`CREATE INDEX IF NOT EXISTS audit_events_created ON audit_events(created_at)`,
+	`CREATE INDEX IF NOT EXISTS players_user ON players(user_id)`,
+	`CREATE INDEX IF NOT EXISTS vods_team ON vods(team_id)`,
+	`CREATE INDEX IF NOT EXISTS roster_history_player ON roster_history(player_id)`,
+	`CREATE INDEX IF NOT EXISTS vods_match ON vods(match_id)`,
+	`CREATE INDEX IF NOT EXISTS vods_recorded ON vods(team_id, recorded_at)`,
+	`CREATE INDEX IF NOT EXISTS matches_team ON matches(team_id, played_at)`,
+	`CREATE INDEX IF NOT EXISTS match_notes_match ON match_notes(match_id)`,
+	`CREATE INDEX IF NOT EXISTS vod_tags_tag ON vod_tags(tag)`,
+}
+
+// dataMigrations fill in rows that predate the columns and tables above.
+// They run on every start and only touch rows still missing the data.
+var dataMigrations = []string{
+	`UPDATE vods SET team_id = (SELECT team_id FROM players WHERE id = vods.player_id) WHERE team_id IS NULL`,
+	`INSERT INTO roster_history (player_id, team_id, joined_at)
+		SELECT id, team_id, date(COALESCE(created_at, CURRENT_TIMESTAMP)) FROM players p
+		WHERE NOT EXISTS (SELECT 1 FROM roster_history h WHERE h.player_id = p.id)`,
+}
+
+// backfillMemberships runs once, on the first start with team scoping
+// (memberships.role is missing until then). Accounts limited to their own
+// teams that aren't in any yet join the teams of the player profiles linked
+// to them; those without one see no team until an admin adds them.
+const backfillMemberships = `INSERT OR IGNORE INTO memberships (user_id, team_id)
+	SELECT u.id, p.team_id FROM users u JOIN players p ON p.user_id = u.id
+	WHERE u.role != 'admin'
+	AND NOT EXISTS (SELECT 1 FROM role_permissions rp WHERE rp.role = u.role AND rp.permission = 'teams:all')
+	AND NOT EXISTS (SELECT 1 FROM memberships m WHERE m.user_id = u.id)`
+
+func (s *Server) migrate() error {
+	for _, stmt := range schemaMigrations {
+		if _, err := s.db.Exec(stmt); err != nil {
+			return fmt.Errorf("migrate: %w", err)
+		}
+	}
+	scoped, err := s.hasColumn("memberships", "role")
+	if err != nil {
+		return fmt.Errorf("migrate memberships.role: %w", err)
+	}
+	for _, c := range columnMigrations {
+		exists, err := s.hasColumn(c.table, c.column)
+		if err != nil {
+			return fmt.Errorf("migrate %s.%s: %w", c.table, c.column, err)
+		}
+		if exists {
+			continue
+		}
+		if _, err := s.db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, c.table, c.column, c.decl)); err != nil {
+			return fmt.Errorf("migrate %s.%s: %w", c.table, c.column, err)
+		}
+	}
+	if err := s.dropUsersRoleCheck(); err != nil {
+		return fmt.Errorf("migrate users: %w", err)
+	}
+	for _, stmt := range indexMigrations {
+		if _, err := s.db.Exec(stmt); err != nil {
+			return fmt.Errorf("migrate: %w", err)
+		}
+	}
+	// Roles come first: the data migrations and the membership backfill
+	// look at their permissions.
+	if err := s.seedRoles(); err != nil {
+		return fmt.Errorf("migrate roles: %w", err)
+	}
+	for _, stmt := range dataMigrations {
+		if _, err := s.db.Exec(stmt); err != nil {
+			return fmt.Errorf("migrate: %w", err)
+		}
+	}
+	if !scoped {
+		if _, err := s.db.Exec(backfillMemberships); err != nil {
+			return fmt.Errorf("migrate memberships: %w", err)
+		}
+	}
+	return nil
+}
+
+var (
+	usersRoleCheck = regexp.MustCompile(`(?i)\s*CHECK\s*\(\s*role\s+IN\s*\([^)]*\)\s*\)`)
+	usersTableName = regexp.MustCompile(`(?i)^CREATE TABLE\s+"?users"?`)
+)
+
+// dropUsersRoleCheck rebuilds users without the CHECK that limited role to
+// player, coach and admin, now that roles live in their own table. SQLite
+// can't drop a constraint in place.
+func (s *Server) dropUsersRoleCheck() error {
+	var ddl string
+	if err := s.db.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'users'`).Scan(&ddl); err != nil {
+		return err
+	}
+	if !usersRoleCheck.MatchString(ddl) {
+		return nil
+	}
+	ddl = usersRoleCheck.ReplaceAllString(ddl, "")
+	ddl = usersTableName.ReplaceAllString(ddl, "CREATE TABLE users_new")
+
+	// foreign_keys is per connection and must be off, or dropping users
+	// would cascade into notes and memberships.
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF`); err != nil {
+		return err
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range []string{
+		ddl,
+		`INSERT INTO users_new SELECT * FROM users`,
+		`DROP TABLE users`,
+		`ALTER TABLE users_new RENAME TO users`,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Println("🔧 Removed the fixed role list from the users table")
+	return nil
+}
+
+func (s *Server) hasColumn(table, column string) (bool, error) {
+	rows, err := s.db.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt any
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return false, err
+		}
+		if strings.EqualFold(name, column) {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
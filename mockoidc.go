@@ -0,0 +1,209 @@
+//go:build ignore
+
+// mockoidc is a throwaway OpenID Connect provider for trying out single
+// sign-on locally. It accepts anyone: the sign-in page asks for a username
+// and groups and puts them in the ID token. Never expose it.
+//
+//	go run mockoidc.go -addr :9000 -client vfe
+//
+// then point config.json at it:
+//
+//	"oidc": {"issuer": "http://localhost:9000", "clientId": "vfe",
+//	  "redirectUrl": "http://localhost:8000/api/auth/oidc/callback",
+//	  "autoProvision": true, "defaultRole": "player",
+//	  "roleMapping": [{"value": "staff", "role": "coach"}]}
+//
+// Scripts can skip the form by adding &user=alice&groups=staff to the
+// authorize URL.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const kid = "mock-1"
+
+type grant struct {
+	clientID, redirectURI, challenge, nonce string
+	user, email, name                       string
+	groups                                  []string
+	expires                                 time.Time
+}
+
+var (
+	addr     = flag.String("addr", ":9000", "listen address")
+	issuer   = flag.String("issuer", "", "issuer URL (default http://localhost<addr>)")
+	clientID = flag.String("client", "vfe", "the only client id accepted")
+
+	key    *rsa.PrivateKey
+	mu     sync.Mutex
+	grants = map[string]grant{}
+)
+
+var page = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html><body><h2>Mock identity provider</h2>
+<form method="GET" action="/authorize">
+{{range $k, $v := .}}<input type="hidden" name="{{$k}}" value="{{index $v 0}}">{{end}}
+<p><input name="user" placeholder="username" required></p>
+<p><input name="groups" placeholder="groups, comma separated"></p>
+<p><button>Sign in</button></p>
+</form></body></html>`))
+
+func main() {
+	flag.Parse()
+	if *issuer == "" {
+		*issuer = "http://localhost" + *addr
+	}
+	var err error
+	if key, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		log.Fatal(err)
+	}
+
+	http.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, 200, map[string]any{
+			"issuer":                                *issuer,
+			"authorization_endpoint":                *issuer + "/authorize",
+			"token_endpoint":                        *issuer + "/token",
+			"jwks_uri":                              *issuer + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+			"code_challenge_methods_supported":      []string{"S256"},
+		})
+	})
+	http.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, 200, map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "use": "sig", "alg": "RS256", "kid": kid,
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	http.HandleFunc("/authorize", authorize)
+	http.HandleFunc("/token", token)
+
+	fmt.Printf("🪪 Mock OIDC provider at %s (client id %q)\n", *issuer, *clientID)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+func authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != *clientID || q.Get("response_type") != "code" {
+		http.Error(w, "unknown client or response_type", 400)
+		return
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "PKCE with S256 is required", 400)
+		return
+	}
+	user := q.Get("user")
+	if user == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		page.Execute(w, q)
+		return
+	}
+	var groups []string
+	for _, g := range strings.Split(q.Get("groups"), ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			groups = append(groups, g)
+		}
+	}
+	code := randomString()
+	mu.Lock()
+	grants[code] = grant{
+		clientID: q.Get("client_id"), redirectURI: q.Get("redirect_uri"),
+		challenge: q.Get("code_challenge"), nonce: q.Get("nonce"),
+		user: user, email: user + "@example.test", name: strings.ToUpper(user[:1]) + user[1:],
+		groups: groups, expires: time.Now().Add(time.Minute),
+	}
+	mu.Unlock()
+
+	back, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "bad redirect_uri", 400)
+		return
+	}
+	bq := back.Query()
+	bq.Set("code", code)
+	bq.Set("state", q.Get("state"))
+	back.RawQuery = bq.Encode()
+	http.Redirect(w, r, back.String(), http.StatusFound)
+}
+
+func token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	code := r.PostForm.Get("code")
+	mu.Lock()
+	g, ok := grants[code]
+	delete(grants, code)
+	mu.Unlock()
+
+	client := r.PostForm.Get("client_id")
+	if u, _, basic := r.BasicAuth(); basic {
+		client, _ = url.QueryUnescape(u)
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case !ok || time.Now().After(g.expires):
+		writeJSON(w, 400, map[string]string{"error": "invalid_grant"})
+		return
+	case client != g.clientID || r.PostForm.Get("redirect_uri") != g.redirectURI:
+		writeJSON(w, 400, map[string]string{"error": "invalid_grant", "error_description": "client or redirect_uri mismatch"})
+		return
+	case base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge:
+		writeJSON(w, 400, map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+		return
+	}
+
+	now := time.Now()
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":                *issuer,
+		"sub":                "mock|" + g.user,
+		"aud":                g.clientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"nonce":              g.nonce,
+		"preferred_username": g.user,
+		"email":              g.email,
+		"name":               g.name,
+		"groups":             g.groups,
+	})
+	idToken.Header["kid"] = kid
+	signed, err := idToken.SignedString(key)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(w, 200, map[string]any{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     signed,
+	})
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
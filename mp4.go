@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"time"
+)
+
+// ----------------------- MP4 PROBING -----------------------
+
+// The movie header (moov/mvhd) of an MP4 holds the time the recording was
+// created and its duration. Recorders that write the moov box last (OBS
+// without faststart) put it at the end of the file, so the boxes are walked
+// with ranged reads rather than by reading the file from the start.
+
+// mp4Epoch is where mvhd times count from.
+var mp4Epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// maxBoxes bounds the walk over one level of boxes in a damaged file.
+const maxBoxes = 4096
+
+var errNoMvhd = errors.New("no moov/mvhd box")
+
+type mvhdInfo struct {
+	Created  time.Time // zero when the recorder left it unset
+	Duration float64   // seconds
+}
+
+func readRange(ctx context.Context, st Storage, key string, off, n int64) ([]byte, error) {
+	rc, err := st.OpenRange(ctx, key, off, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	buf := make([]byte, n)
+	k, err := io.ReadFull(rc, buf)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return buf[:k], nil
+	}
+	return buf, err
+}
+
+// findBox looks for a box of type typ among the boxes between start and
+// end, returning where it starts, its total size and its header size.
+func findBox(ctx context.Context, st Storage, key string, start, end int64, typ string) (off, size, hdr int64, err error) {
+	off = start
+	for i := 0; i < maxBoxes && off+8 <= end; i++ {
+		b, err := readRange(ctx, st, key, off, 16)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		if len(b) < 8 {
+			break
+		}
+		size, hdr = int64(binary.BigEndian.Uint32(b)), 8
+		switch size {
+		case 0: // runs to the end of its parent
+			size = end - off
+		case 1: // 64-bit size follows the type
+			if len(b) < 16 {
+				return 0, 0, 0, errNoMvhd
+			}
+			size, hdr = int64(binary.BigEndian.Uint64(b[8:])), 16
+		}
+		// Compared against what's left, as a 64-bit size near the
+		// maximum would overflow off+size.
+		if size < hdr || size > end-off {
+			break
+		}
+		if string(b[4:8]) == typ {
+			return off, size, hdr, nil
+		}
+		off += size
+	}
+	return 0, 0, 0, errNoMvhd
+}
+
+// readMvhd reads the movie header of the MP4 stored under key.
+func readMvhd(ctx context.Context, st Storage, key string, fileSize int64) (mvhdInfo, error) {
+	var info mvhdInfo
+	moov, moovSize, moovHdr, err := findBox(ctx, st, key, 0, fileSize, "moov")
+	if err != nil {
+		return info, err
+	}
+	mvhd, _, mvhdHdr, err := findBox(ctx, st, key, moov+moovHdr, moov+moovSize, "mvhd")
+	if err != nil {
+		return info, err
+	}
+	b, err := readRange(ctx, st, key, mvhd+mvhdHdr, 32)
+	if err != nil {
+		return info, err
+	}
+
+	if len(b) == 0 {
+		return info, errNoMvhd
+	}
+	var created, duration uint64
+	var timescale uint32
+	switch {
+	case len(b) >= 20 && b[0] == 0:
+		created = uint64(binary.BigEndian.Uint32(b[4:]))
+		timescale = binary.BigEndian.Uint32(b[12:])
+		duration = uint64(binary.BigEndian.Uint32(b[16:]))
+	case len(b) >= 32 && b[0] == 1:
+		created = binary.BigEndian.Uint64(b[4:])
+		timescale = binary.BigEndian.Uint32(b[20:])
+		duration = binary.BigEndian.Uint64(b[24:])
+	default:
+		return info, fmt.Errorf("unsupported mvhd version %d", b[0])
+	}
+	if timescale > 0 {
+		info.Duration = float64(duration) / float64(timescale)
+	}
+	// Anything before 2000 is an unset or zeroed field, not a real date.
+	if t := mp4Epoch.Add(time.Duration(created) * time.Second); created > 0 && t.Year() >= 2000 && t.Before(time.Now().Add(24*time.Hour)) {
+		info.Created = t
+	}
+	return info, nil
+}
+
+type probeJob struct {
+	VodID int64 `json:"vod_id"`
+}
+
+func (s *Server) enqueueProbe(vodID int64) {
+	if _, err := s.jobs.enqueue("probe", probeJob{VodID: vodID}, fmt.Sprintf("probe:%d", vodID)); err != nil {
+		log.Println("Probe queue error:", err)
+	}
+}
+
+// probeVod records a VOD's mvhd creation time and duration, and the size
+// it read them at. Files without a usable header are remembered too, so
+// they aren't probed again until they change. When the VOD is in a match,
+// the match's offsets are estimated again.
+func (s *Server) probeVod(ctx context.Context, payload json.RawMessage) error {
+	var job probeJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return permanent(err)
+	}
+	var filePath string
+	var matchID sql.NullInt64
+	err := s.db.QueryRow(`SELECT file_path, match_id FROM vods WHERE id = ?`, job.VodID).Scan(&filePath, &matchID)
+	if err == sql.ErrNoRows {
+		return permanent(err)
+	} else if err != nil {
+		return err
+	}
+
+	key := vodKey(filePath)
+	obj, err := s.store.Stat(ctx, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return permanent(err)
+	} else if err != nil {
+		return err
+	}
+	var created, duration any
+	info, err := readMvhd(ctx, s.store, key, obj.Size)
+	if err != nil && ctx.Err() != nil {
+		return err
+	} else if err != nil {
+		log.Printf("Probe VOD %d: %v", job.VodID, err)
+	} else {
+		if !info.Created.IsZero() {
+			created = info.Created.Format(time.DateTime)
+		}
+		if info.Duration > 0 {
+			duration = info.Duration
+		}
+	}
+	if _, err := s.db.Exec(`UPDATE vods SET media_created_at = ?, duration_seconds = ?, probe_size = ? WHERE id = ?`,
+		created, duration, obj.Size, job.VodID); err != nil {
+		return err
+	}
+	if matchID.Valid {
+		return s.syncMatch(matchID.Int64, false)
+	}
+	return nil
+}
@@ -0,0 +1,583 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ----------------------- OIDC SINGLE SIGN-ON -----------------------
+
+// OIDCConfig turns on "Sign in with ..." against an OpenID Connect
+// provider. Leave issuer empty to turn it off.
+type OIDCConfig struct {
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"clientId"`
+	ClientSecret string   `json:"clientSecret"` // optional; PKCE is always used
+	RedirectURL  string   `json:"redirectUrl"`  // e.g. https://vfe.example.com/api/auth/oidc/callback
+	Scopes       []string `json:"scopes"`       // default openid, profile, email
+	ButtonLabel  string   `json:"buttonLabel"`  // default "Sign in with SSO"
+
+	UsernameClaim string `json:"usernameClaim"` // default preferred_username
+	RoleClaim     string `json:"roleClaim"`     // default groups
+	// RoleMapping maps values of roleClaim to VFE roles. The first entry
+	// the user has wins, so list the most privileged first.
+	RoleMapping []struct {
+		Value string `json:"value"`
+		Role  string `json:"role"`
+	} `json:"roleMapping"`
+	// DefaultRole is given to new users no mapping matches. Empty refuses
+	// them instead.
+	DefaultRole string `json:"defaultRole"`
+
+	AutoProvision bool `json:"autoProvision"` // create users on first login
+	// LinkByUsername links a first login to an existing user with the same
+	// username. Only turn this on if the provider controls those names.
+	LinkByUsername bool `json:"linkByUsername"`
+}
+
+const (
+	oidcStateTTL = 10 * time.Minute
+	ssoCodeTTL   = time.Minute
+	// jwksMinRefresh keeps tokens with unknown key ids from making us
+	// hammer the provider.
+	jwksMinRefresh = time.Minute
+
+	// The state is also kept in a cookie, so a callback only completes in
+	// the browser that started the login and nobody can be signed in to
+	// someone else's account by following their callback link.
+	oidcStateCookie     = "vfe_oidc_state"
+	oidcStateCookiePath = "/api/auth/oidc/"
+)
+
+type oidcProvider struct {
+	cfg    OIDCConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+	keysAt    time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func newOIDCProvider(cfg OIDCConfig) (*oidcProvider, error) {
+	if cfg.Issuer == "" {
+		return nil, nil
+	}
+	if cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("oidc needs clientId and redirectUrl")
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "profile", "email"}
+	}
+	if !slices.Contains(cfg.Scopes, "openid") {
+		cfg.Scopes = append([]string{"openid"}, cfg.Scopes...)
+	}
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = "preferred_username"
+	}
+	if cfg.RoleClaim == "" {
+		cfg.RoleClaim = "groups"
+	}
+	if cfg.ButtonLabel == "" {
+		cfg.ButtonLabel = "Sign in with SSO"
+	}
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+	return &oidcProvider{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+// getJSON fetches url into v.
+func (p *oidcProvider) getJSON(url string, v any) error {
+	resp, err := p.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// endpoints fetches the provider's discovery document once.
+func (p *oidcProvider) endpoints() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	var d oidcDiscovery
+	if err := p.getJSON(p.cfg.Issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != p.cfg.Issuer {
+		return nil, fmt.Errorf("provider says its issuer is %q, config says %q", d.Issuer, p.cfg.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("discovery document is missing endpoints")
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// signingKey finds the provider key for a token, refetching the key set
+// when the kid is new (providers rotate keys).
+func (p *oidcProvider) signingKey(t *jwt.Token) (any, error) {
+	kid, _ := t.Header["kid"].(string)
+	d, err := p.endpoints()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key := p.lookupKey(kid); key != nil {
+		return key, nil
+	}
+	if time.Since(p.keysAt) < jwksMinRefresh {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	p.keysAt = time.Now()
+	if err := p.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	p.keys = map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) > 4 {
+			continue
+		}
+		p.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if key := p.lookupKey(kid); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookupKey is called with p.mu held. Tokens without a kid are accepted
+// only when the provider has a single key.
+func (p *oidcProvider) lookupKey(kid string) *rsa.PublicKey {
+	if kid == "" && len(p.keys) == 1 {
+		for _, k := range p.keys {
+			return k
+		}
+	}
+	return p.keys[kid]
+}
+
+// exchange trades an authorization code for the verified ID token claims.
+func (p *oidcProvider) exchange(code, verifier, nonce string) (jwt.MapClaims, error) {
+	d, err := p.endpoints()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if p.cfg.ClientSecret == "" {
+		form.Set("client_id", p.cfg.ClientID)
+	}
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return nil, fmt.Errorf("token response: %w", err)
+	}
+	if tok.Error != "" {
+		return nil, fmt.Errorf("token endpoint: %s %s", tok.Error, tok.ErrorDescription)
+	}
+	if tok.IDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(tok.IDToken, claims, p.signingKey,
+		jwt.WithValidMethods([]string{"RS256"}),
+		jwt.WithIssuer(d.Issuer),
+		jwt.WithAudience(p.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("id_token: %w", err)
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, errors.New("id_token nonce doesn't match")
+	}
+	if aud, _ := claims.GetAudience(); len(aud) > 1 {
+		if azp, _ := claims["azp"].(string); azp != p.cfg.ClientID {
+			return nil, errors.New("id_token was issued to another client")
+		}
+	}
+	return claims, nil
+}
+
+// claimStrings reads a claim that may be a string or a list of strings.
+func claimStrings(claims jwt.MapClaims, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var out []string
+		for _, x := range v {
+			if s, ok := x.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// mappedRole is the role for the first roleMapping entry the user's claim
+// has, or "".
+func (p *oidcProvider) mappedRole(claims jwt.MapClaims) string {
+	values := claimStrings(claims, p.cfg.RoleClaim)
+	for _, m := range p.cfg.RoleMapping {
+		if slices.Contains(values, m.Value) {
+			return m.Role
+		}
+	}
+	return ""
+}
+
+// ----------------------- OIDC ENDPOINTS -----------------------
+
+// oidcInfo tells the login page whether to show the SSO button.
+func (s *Server) oidcInfo(w http.ResponseWriter, r *http.Request) {
+	if s.oidc == nil {
+		writeJSON(w, 200, map[string]any{"enabled": false})
+		return
+	}
+	writeJSON(w, 200, map[string]any{"enabled": true, "label": s.oidc.cfg.ButtonLabel})
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// oidcLogin sends the browser to the provider.
+func (s *Server) oidcLogin(w http.ResponseWriter, r *http.Request) {
+	if s.oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	d, err := s.oidc.endpoints()
+	if err != nil {
+		log.Println("OIDC discovery error:", err)
+		http.Error(w, "identity provider unavailable", 502)
+		return
+	}
+	state, nonce, verifier := newSecret(), newSecret(), newSecret()
+	now := time.Now()
+	s.db.Exec(`DELETE FROM oidc_states WHERE expires_at < ?`, now.Unix())
+	if _, err := s.db.Exec(`INSERT INTO oidc_states (state_hash, nonce, verifier, expires_at) VALUES (?, ?, ?, ?)`,
+		hashSecret(state), nonce, verifier, now.Add(oidcStateTTL).Unix()); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	s.setCookie(w, r, oidcStateCookie, state, oidcStateCookiePath, int(oidcStateTTL/time.Second), true)
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {s.oidc.cfg.ClientID},
+		"redirect_uri":          {s.oidc.cfg.RedirectURL},
+		"scope":                 {strings.Join(s.oidc.cfg.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// ssoFail sends the browser back to the login page with a message.
+func ssoFail(w http.ResponseWriter, r *http.Request, msg string) {
+	http.Redirect(w, r, "/index.html?sso_error="+url.QueryEscape(msg), http.StatusFound)
+}
+
+// oidcCallback finishes the provider round trip, finds or creates the user
+// and hands the browser a one-time code for /api/auth/oidc/exchange, so
+// tokens never appear in a URL.
+func (s *Server) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	if s.oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	c, err := r.Cookie(oidcStateCookie)
+	s.setCookie(w, r, oidcStateCookie, "", oidcStateCookiePath, -1, true)
+	if e := q.Get("error"); e != "" {
+		ssoFail(w, r, "sign-in was cancelled or refused ("+e+")")
+		return
+	}
+	if err != nil || c.Value == "" || subtle.ConstantTimeCompare([]byte(c.Value), []byte(q.Get("state"))) != 1 {
+		ssoFail(w, r, "sign-in was started in another browser, please try again")
+		return
+	}
+	var nonce, verifier string
+	err = s.db.QueryRow(`DELETE FROM oidc_states WHERE state_hash = ? AND expires_at > ? RETURNING nonce, verifier`,
+		hashSecret(q.Get("state")), time.Now().Unix()).Scan(&nonce, &verifier)
+	if err != nil {
+		ssoFail(w, r, "sign-in expired, please try again")
+		return
+	}
+	claims, err := s.oidc.exchange(q.Get("code"), verifier, nonce)
+	if err != nil {
+		log.Println("OIDC login error:", err)
+		ssoFail(w, r, "the identity provider's response could not be verified")
+		return
+	}
+
+	userID, username, err := s.oidcUser(r, claims)
+	var refused errSSORefused
+	if errors.As(err, &refused) {
+		s.recordLogin(r, username, false, "sso_refused")
+		ssoFail(w, r, refused.Error())
+		return
+	} else if err != nil {
+		log.Println("OIDC user error:", err)
+		ssoFail(w, r, "database error")
+		return
+	}
+	code := newSecret()
+	if _, err := s.db.Exec(`INSERT INTO sso_codes (code_hash, user_id, expires_at) VALUES (?, ?, ?)`,
+		hashSecret(code), userID, time.Now().Add(ssoCodeTTL).Unix()); err != nil {
+		ssoFail(w, r, "database error")
+		return
+	}
+	http.Redirect(w, r, "/index.html?sso="+url.QueryEscape(code), http.StatusFound)
+}
+
+// errSSORefused messages are shown to the user on the login page.
+type errSSORefused string
+
+func (e errSSORefused) Error() string { return string(e) }
+
+// oidcUser finds the user linked to the provider's subject, linking or
+// creating one on first login per config. A matching roleMapping entry
+// updates the role on every login.
+func (s *Server) oidcUser(r *http.Request, claims jwt.MapClaims) (int64, string, error) {
+	cfg := s.oidc.cfg
+	sub, _ := claims.GetSubject()
+	if sub == "" {
+		return 0, "", errSSORefused("the identity provider sent no subject")
+	}
+	username, _ := claims[cfg.UsernameClaim].(string)
+	if username == "" {
+		username, _ = claims["email"].(string)
+	}
+	if username == "" {
+		username = sub
+	}
+	email, _ := claims["email"].(string)
+	role := s.oidc.mappedRole(claims)
+	if role != "" && !s.validRole(role) {
+		log.Printf("OIDC roleMapping points at unknown role %q", role)
+		role = ""
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, username, err
+	}
+	defer tx.Rollback()
+
+	var userID int64
+	var disabled, linked, provisioned bool
+	var prevRole string
+	err = tx.QueryRow(`SELECT u.id, u.username, u.role, u.disabled_at IS NOT NULL FROM user_identities i
+		JOIN users u ON u.id = i.user_id WHERE i.issuer = ? AND i.subject = ?`,
+		cfg.Issuer, sub).Scan(&userID, &username, &prevRole, &disabled)
+	switch {
+	case err == nil:
+	case err != sql.ErrNoRows:
+		return 0, username, err
+	default:
+		linked = true
+		if cfg.LinkByUsername {
+			err = tx.QueryRow(`SELECT id, role, disabled_at IS NOT NULL FROM users WHERE username = ?`, username).
+				Scan(&userID, &prevRole, &disabled)
+			if err != nil && err != sql.ErrNoRows {
+				return 0, username, err
+			}
+		}
+		if userID == 0 {
+			if !cfg.AutoProvision {
+				return 0, username, errSSORefused("no VFE account is linked to this login; ask an admin")
+			}
+			if role == "" {
+				role = cfg.DefaultRole
+			}
+			if role == "" || !s.validRole(role) {
+				return 0, username, errSSORefused("your account has no VFE role; ask an admin")
+			}
+			if userID, username, err = provisionSSOUser(tx, username, role, claims); err != nil {
+				return 0, username, err
+			}
+			provisioned, prevRole = true, role
+			fmt.Printf("👤 Created %s (%s) from single sign-on\n", username, role)
+		}
+		if _, err := tx.Exec(`INSERT INTO user_identities (user_id, issuer, subject, email) VALUES (?, ?, ?, ?)`,
+			userID, cfg.Issuer, sub, email); err != nil {
+			return 0, username, err
+		}
+	}
+	if disabled {
+		return 0, username, errSSORefused("account disabled")
+	}
+	if role != "" {
+		if _, err := tx.Exec(`UPDATE users SET role = ? WHERE id = ?`, role, userID); err != nil {
+			return 0, username, err
+		}
+	}
+	if _, err := tx.Exec(`UPDATE user_identities SET email = ?, last_login_at = CURRENT_TIMESTAMP
+		WHERE issuer = ? AND subject = ?`, email, cfg.Issuer, sub); err != nil {
+		return 0, username, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, username, err
+	}
+
+	identity := map[string]any{"issuer": cfg.Issuer, "subject": sub}
+	if provisioned {
+		s.auditAs(r, userID, "user.create", "user", userID, nil,
+			map[string]any{"username": username, "role": role, "sso": identity})
+	} else if linked {
+		s.auditAs(r, userID, "sso.link", "user", userID, nil, identity)
+	}
+	if role != "" && role != prevRole {
+		s.auditAs(r, userID, "user.update", "user", userID,
+			map[string]any{"role": prevRole}, map[string]any{"role": role, "source": "sso"})
+	}
+	return userID, username, nil
+}
+
+// provisionSSOUser creates an account with an unusable password. If the
+// username is taken it gets a number, since auto-provisioning must never
+// take over an existing account.
+func provisionSSOUser(tx *sql.Tx, username, role string, claims jwt.MapClaims) (int64, string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(newSecret()), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, username, err
+	}
+	var displayName any
+	if name, _ := claims["name"].(string); name != "" {
+		displayName = name
+	}
+	base := username
+	for n := 2; n <= 100; n++ {
+		res, err := tx.Exec(`INSERT INTO users (username, password_hash, role, display_name) VALUES (?, ?, ?, ?)`,
+			username, hash, role, displayName)
+		if err == nil {
+			id, _ := res.LastInsertId()
+			return id, username, nil
+		}
+		if !strings.Contains(err.Error(), "UNIQUE") {
+			return 0, username, err
+		}
+		username = fmt.Sprintf("%s-%d", base, n)
+	}
+	return 0, base, errSSORefused("couldn't pick a free username; ask an admin")
+}
+
+// oidcExchange turns the one-time code from the callback into a session,
+// or into the 2FA step for users who have it on.
+func (s *Server) oidcExchange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", 405)
+		return
+	}
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Code == "" {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	var userID int64
+	err := s.db.QueryRow(`DELETE FROM sso_codes WHERE code_hash = ? AND expires_at > ? RETURNING user_id`,
+		hashSecret(body.Code), time.Now().Unix()).Scan(&userID)
+	if err != nil {
+		http.Error(w, "sign-in expired, please try again", 401)
+		return
+	}
+	u := sessionUser{ID: userID}
+	err = s.db.QueryRow(`SELECT username, role, must_change_password, totp_enabled_at IS NOT NULL FROM users
+		WHERE id = ? AND disabled_at IS NULL`, userID).Scan(&u.Username, &u.Role, &u.MustChangePassword, &u.MFAEnabled)
+	if err != nil {
+		http.Error(w, "account disabled", 403)
+		return
+	}
+	if u.MFAEnabled {
+		token, err := s.mfaToken(u.ID)
+		if err != nil {
+			http.Error(w, "token error", 500)
+			return
+		}
+		writeJSON(w, 200, map[string]any{"mfa_required": true, "mfa_token": token})
+		return
+	}
+	s.recordLogin(r, u.Username, true, "sso")
+	s.startSession(w, r, u)
+}
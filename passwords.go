@@ -0,0 +1,209 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ----------------------- PASSWORDS -----------------------
+
+const minPasswordLength = 8
+
+func checkNewPassword(pw string) error {
+	if len(pw) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	if len(pw) > 72 {
+		return fmt.Errorf("password must be at most 72 bytes")
+	}
+	return nil
+}
+
+// setPassword stores a new hash, clears must_change_password and signs the
+// user out of every session except keepSession (0 for none).
+func (s *Server) setPassword(userID int64, password string, keepSession int64) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE users SET password_hash = ?, must_change_password = 0,
+		password_changed_at = CURRENT_TIMESTAMP WHERE id = ?`, hash, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND id != ? AND revoked_at IS NULL`, userID, keepSession); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE password_resets SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND used_at IS NULL`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// passwordChangePaths are all a session may use while its user still has
+// to pick a new password.
+var passwordChangePaths = map[string]bool{
+	"/api/auth/change-password": true,
+	"/api/auth/logout":          true,
+}
+
+// changePassword lets a signed-in user pick a new password, given the
+// current one. Their other sessions are signed out.
+func (s *Server) changePassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", 405)
+		return
+	}
+	var body struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	userID, _ := userFrom(r.Context())
+
+	var hash string
+	if err := s.db.QueryRow(`SELECT password_hash FROM users WHERE id = ?`, userID).Scan(&hash); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(body.CurrentPassword)) != nil {
+		http.Error(w, "current password is wrong", 403)
+		return
+	}
+	if err := checkNewPassword(body.NewPassword); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if body.NewPassword == body.CurrentPassword {
+		http.Error(w, "new password must be different", 400)
+		return
+	}
+	if err := s.setPassword(userID, body.NewPassword, sessionFrom(r.Context())); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	s.audit(r, "password.change", "user", userID, nil, nil)
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
+
+// ----------------------- ADMIN RESET -----------------------
+
+// adminResetPassword issues a one-time reset token for a user. Until they
+// use it (or change their password after logging in) the account is locked
+// to choosing a new password, and all its sessions are signed out.
+func (s *Server) adminResetPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", 405)
+		return
+	}
+	var body struct {
+		UserID int64 `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.UserID == 0 {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	if !s.mayManageUser(w, r, body.UserID) {
+		return
+	}
+	adminID, _ := userFrom(r.Context())
+
+	token := newSecret()
+	expires := time.Now().Add(time.Duration(s.cfg.PasswordResetHours) * time.Hour)
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`UPDATE users SET must_change_password = 1 WHERE id = ?`, body.UserID)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "user not found", 404)
+		return
+	}
+	// Only the newest link works.
+	if _, err := tx.Exec(`UPDATE password_resets SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND used_at IS NULL`, body.UserID); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if _, err := tx.Exec(`INSERT INTO password_resets (user_id, token_hash, created_by, expires_at)
+		VALUES (?, ?, ?, ?)`, body.UserID, hashSecret(token), adminID, expires.Unix()); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if _, err := tx.Exec(`UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND revoked_at IS NULL`, body.UserID); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "commit error", 500)
+		return
+	}
+	s.audit(r, "password.reset_issue", "user", body.UserID, nil, map[string]any{"expires_at": expires.UTC().Format(time.DateTime)})
+
+	writeJSON(w, 200, map[string]any{
+		"ok":         true,
+		"token":      token,
+		"reset_url":  "/index.html?reset=" + url.QueryEscape(token),
+		"expires_at": expires.UTC().Format(time.DateTime),
+	})
+}
+
+// resetPassword sets a new password using a reset token. No login needed.
+func (s *Server) resetPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", 405)
+		return
+	}
+	var body struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Token == "" {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	if err := checkNewPassword(body.NewPassword); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	var userID int64
+	err := s.db.QueryRow(`SELECT user_id FROM password_resets
+		WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?`,
+		hashSecret(body.Token), time.Now().Unix()).Scan(&userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "reset link is invalid or has expired", 400)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if err := s.setPassword(userID, body.NewPassword, 0); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	s.auditAs(r, userID, "password.reset", "user", userID, nil, nil)
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
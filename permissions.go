@@ -0,0 +1,689 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ----------------------- PERMISSIONS -----------------------
+
+// permissions is every permission a role can be given.
+var permissions = []string{
+	"vods:read",      // list VODs, teams and players
+	"vods:upload",    // upload to teams you belong to
+	"notes:read",     // read notes
+	"notes:write",    // add, edit and delete your own notes
+	"teams:all",      // act on every team, not just ones you are a member of
+	"teams:manage",   // add teams and players, set quotas
+	"storage:manage", // scans, jobs, duplicates, usage, retention and archiving
+	"users:manage",   // accounts, sessions, login audit, API keys, team memberships
+	"invites:create", // invite players
+	"roles:manage",   // edit roles and their permissions
+	"audit:read",     // browse and export the audit log
+}
+
+// builtinRoles are created on first start. admin always has every
+// permission and can't be edited; the others can be.
+var builtinRoles = []struct {
+	name, description string
+	mfa               bool
+	perms             []string
+}{
+	{"admin", "Full access", true, nil},
+	{"coach", "Reviews and uploads VODs for every team, invites players", true,
+		[]string{"vods:read", "vods:upload", "notes:read", "notes:write", "teams:all", "invites:create"}},
+	{"assistant_coach", "Reviews and uploads VODs for every team", true,
+		[]string{"vods:read", "vods:upload", "notes:read", "notes:write", "teams:all"}},
+	{"analyst", "Reads everything, changes nothing", false,
+		[]string{"vods:read", "notes:read", "teams:all"}},
+	{"player", "Reviews VODs and uploads to their own teams", false,
+		[]string{"vods:read", "vods:upload", "notes:read", "notes:write"}},
+}
+
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+
+// roleCache keeps the roles table in memory, since every request checks it.
+// It is reloaded whenever roles change through the API.
+type roleCache struct {
+	mu    sync.RWMutex
+	perms map[string]map[string]bool
+	mfa   map[string]bool
+}
+
+func (s *Server) seedRoles() error {
+	for _, br := range builtinRoles {
+		res, err := s.db.Exec(`INSERT OR IGNORE INTO roles (name, description, builtin, mfa_required) VALUES (?, ?, 1, ?)`,
+			br.name, br.description, br.mfa)
+		if err != nil {
+			return err
+		}
+		// Permissions are only seeded once, so edits to built-in roles stick.
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		for _, p := range br.perms {
+			if _, err := s.db.Exec(`INSERT OR IGNORE INTO role_permissions (role, permission) VALUES (?, ?)`, br.name, p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) loadRoles() error {
+	perms := map[string]map[string]bool{}
+	mfa := map[string]bool{}
+	rows, err := s.db.Query(`SELECT name, mfa_required FROM roles`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var name string
+		var required bool
+		if err := rows.Scan(&name, &required); err != nil {
+			rows.Close()
+			return err
+		}
+		perms[name] = map[string]bool{}
+		mfa[name] = required
+	}
+	rows.Close()
+
+	rows, err = s.db.Query(`SELECT role, permission FROM role_permissions`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var role, perm string
+		if err := rows.Scan(&role, &perm); err != nil {
+			return err
+		}
+		if perms[role] != nil {
+			perms[role][perm] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	s.roles.mu.Lock()
+	s.roles.perms, s.roles.mfa = perms, mfa
+	s.roles.mu.Unlock()
+	return nil
+}
+
+func (s *Server) validRole(role string) bool {
+	s.roles.mu.RLock()
+	defer s.roles.mu.RUnlock()
+	_, ok := s.roles.perms[role]
+	return ok
+}
+
+func (s *Server) roleHas(role, perm string) bool {
+	if role == "admin" {
+		return true
+	}
+	s.roles.mu.RLock()
+	defer s.roles.mu.RUnlock()
+	return s.roles.perms[role][perm]
+}
+
+func (s *Server) roleRequiresMFA(role string) bool {
+	s.roles.mu.RLock()
+	defer s.roles.mu.RUnlock()
+	return s.roles.mfa[role]
+}
+
+// can checks a permission against the user's own role.
+func (s *Server) can(ctx context.Context, perm string) bool {
+	return s.roleHas(getRole(ctx), perm)
+}
+
+// canGrant reports whether the user may hand out role: only roles with no
+// permission they lack themselves, so nobody can promote past their own
+// level.
+func (s *Server) canGrant(ctx context.Context, role string) bool {
+	mine := getRole(ctx)
+	if mine == "admin" {
+		return true
+	}
+	if role == "admin" {
+		return false
+	}
+	for _, p := range permissions {
+		if s.roleHas(role, p) && !s.roleHas(mine, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// canTeam checks a permission for one team. Members use their membership's
+// role override if it has one, else their own role; everyone else needs the
+// permission plus teams:all.
+func (s *Server) canTeam(ctx context.Context, perm string, teamID int64) (bool, error) {
+	userID, role := userFrom(ctx)
+	var override sql.NullString
+	err := s.db.QueryRow(`SELECT role FROM memberships WHERE user_id = ? AND team_id = ?`, userID, teamID).Scan(&override)
+	if err == sql.ErrNoRows {
+		return s.roleHas(role, perm) && s.roleHas(role, "teams:all"), nil
+	} else if err != nil {
+		return false, err
+	}
+	if override.Valid && override.String != "" {
+		role = override.String
+	}
+	return s.roleHas(role, perm), nil
+}
+
+// teamScope is the SQL condition that limits column to the teams a user
+// without teams:all is a member of, following canTeam.
+func teamScope(column string, userID int64) (string, []any) {
+	return column + " IN (SELECT team_id FROM memberships WHERE user_id = ?)", []any{userID}
+}
+
+// requireTeam writes the error response itself and reports whether the
+// handler may go on.
+func (s *Server) requireTeam(w http.ResponseWriter, r *http.Request, perm string, teamID int64) bool {
+	ok, err := s.canTeam(r.Context(), perm, teamID)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return false
+	}
+	if !ok {
+		http.Error(w, "forbidden", 403)
+		return false
+	}
+	return true
+}
+
+// mayManageUser stops users:manage holders from acting on accounts whose
+// role they couldn't grant, such as admins. It writes the 403 itself.
+// Unknown users pass, so the handler can answer 404.
+func (s *Server) mayManageUser(w http.ResponseWriter, r *http.Request, userID int64) bool {
+	var role string
+	err := s.db.QueryRow(`SELECT role FROM users WHERE id = ?`, userID).Scan(&role)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "db error", 500)
+		return false
+	}
+	if err == nil && !s.canGrant(r.Context(), role) {
+		http.Error(w, "you can't manage that user", 403)
+		return false
+	}
+	return true
+}
+
+// vodTeam is the team a VOD belongs to, for team-scoped checks.
+func (s *Server) vodTeam(vodID any) (int64, error) {
+	var teamID int64
+	err := s.db.QueryRow(`SELECT COALESCE(v.team_id, p.team_id) FROM vods v JOIN players p ON p.id = v.player_id
+		WHERE v.id = ?`, vodID).Scan(&teamID)
+	return teamID, err
+}
+
+// requireVod is requireTeam for the team a VOD belongs to.
+func (s *Server) requireVod(w http.ResponseWriter, r *http.Request, perm string, vodID any) bool {
+	teamID, err := s.vodTeam(vodID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "vod not found", 404)
+		return false
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return false
+	}
+	return s.requireTeam(w, r, perm, teamID)
+}
+
+// require wraps a handler that needs perm. It goes inside auth.
+func (s *Server) require(perm string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.can(r.Context(), perm) {
+			http.Error(w, "forbidden", 403)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// ----------------------- ROLE MANAGEMENT -----------------------
+
+type Role struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Builtin     bool     `json:"builtin"`
+	MFARequired bool     `json:"mfa_required"`
+	Permissions []string `json:"permissions"`
+	Users       int      `json:"users"`
+}
+
+// rolesHandler serves /api/admin/roles (GET list, POST create) and
+// /api/admin/roles/{name} (PATCH, DELETE).
+func (s *Server) rolesHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/roles"), "/")
+	if name == "" {
+		switch r.Method {
+		case http.MethodGet:
+			s.listRoles(w, r)
+		case http.MethodPost:
+			s.createRole(w, r)
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+		return
+	}
+	if name == "admin" {
+		http.Error(w, "the admin role can't be changed", 409)
+		return
+	}
+	if !s.validRole(name) {
+		http.Error(w, "role not found", 404)
+		return
+	}
+	// Like accounts, roles can only be changed by someone who could grant
+	// them, and nobody edits their own.
+	if name == getRole(r.Context()) {
+		http.Error(w, "you can't change your own role", 403)
+		return
+	}
+	if !s.canGrant(r.Context(), name) {
+		http.Error(w, "you can't change that role", 403)
+		return
+	}
+	switch r.Method {
+	case http.MethodPatch:
+		s.updateRole(w, r, name)
+	case http.MethodDelete:
+		s.deleteRole(w, r, name)
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
+
+func (s *Server) listRoles(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.db.Query(`SELECT r.name, COALESCE(r.description, ''), r.builtin, r.mfa_required,
+		(SELECT COUNT(*) FROM users u WHERE u.role = r.name)
+		FROM roles r ORDER BY r.builtin DESC, r.name`)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer rows.Close()
+	roles := []Role{}
+	for rows.Next() {
+		var ro Role
+		if err := rows.Scan(&ro.Name, &ro.Description, &ro.Builtin, &ro.MFARequired, &ro.Users); err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		ro.Permissions = []string{}
+		for _, p := range permissions {
+			if s.roleHas(ro.Name, p) {
+				ro.Permissions = append(ro.Permissions, p)
+			}
+		}
+		roles = append(roles, ro)
+	}
+	writeJSON(w, 200, map[string]any{"roles": roles, "permissions": permissions})
+}
+
+// roleSummary is what the audit log records about a role.
+func (s *Server) roleSummary(name string) map[string]any {
+	perms := []string{}
+	for _, p := range permissions {
+		if s.roleHas(name, p) {
+			perms = append(perms, p)
+		}
+	}
+	return map[string]any{"permissions": perms, "mfa_required": s.roleRequiresMFA(name)}
+}
+
+type roleBody struct {
+	Name        string    `json:"name"`
+	Description *string   `json:"description"`
+	MFARequired *bool     `json:"mfa_required"`
+	Permissions *[]string `json:"permissions"`
+}
+
+func checkPermissions(perms []string) error {
+	for _, p := range perms {
+		if !slices.Contains(permissions, p) {
+			return fmt.Errorf("unknown permission %q", p)
+		}
+	}
+	return nil
+}
+
+// grantablePermissions follows canGrant for a permission list: a role may
+// only be given permissions the user holds themselves.
+func (s *Server) grantablePermissions(ctx context.Context, perms []string) error {
+	for _, p := range perms {
+		if !s.can(ctx, p) {
+			return fmt.Errorf("you can't grant permission %q", p)
+		}
+	}
+	return nil
+}
+
+// setRolePermissions replaces a role's permissions inside tx.
+func setRolePermissions(tx *sql.Tx, role string, perms []string) error {
+	if _, err := tx.Exec(`DELETE FROM role_permissions WHERE role = ?`, role); err != nil {
+		return err
+	}
+	for _, p := range perms {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO role_permissions (role, permission) VALUES (?, ?)`, role, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createRole takes {name, description, permissions, mfa_required}.
+func (s *Server) createRole(w http.ResponseWriter, r *http.Request) {
+	var body roleBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	if !roleNamePattern.MatchString(body.Name) {
+		http.Error(w, "role names are lowercase letters, digits and underscores", 400)
+		return
+	}
+	var perms []string
+	if body.Permissions != nil {
+		perms = *body.Permissions
+	}
+	if err := checkPermissions(perms); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := s.grantablePermissions(r.Context(), perms); err != nil {
+		http.Error(w, err.Error(), 403)
+		return
+	}
+	var description string
+	if body.Description != nil {
+		description = strings.TrimSpace(*body.Description)
+	}
+	mfa := body.MFARequired != nil && *body.MFARequired
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`INSERT INTO roles (name, description, builtin, mfa_required) VALUES (?, ?, 0, ?)`,
+		body.Name, description, mfa); err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			http.Error(w, "role already exists", 409)
+			return
+		}
+		http.Error(w, "db error", 500)
+		return
+	}
+	if err := setRolePermissions(tx, body.Name, perms); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "commit error", 500)
+		return
+	}
+	if err := s.loadRoles(); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	s.audit(r, "role.create", "role", body.Name, nil, s.roleSummary(body.Name))
+	writeJSON(w, 201, map[string]any{"ok": true, "role": body.Name})
+}
+
+// updateRole changes description, mfa_required or the full permission list.
+func (s *Server) updateRole(w http.ResponseWriter, r *http.Request, name string) {
+	var body roleBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	if body.Permissions != nil {
+		if err := checkPermissions(*body.Permissions); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := s.grantablePermissions(r.Context(), *body.Permissions); err != nil {
+			http.Error(w, err.Error(), 403)
+			return
+		}
+	}
+	before := s.roleSummary(name)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer tx.Rollback()
+	if body.Description != nil {
+		if _, err := tx.Exec(`UPDATE roles SET description = ? WHERE name = ?`, strings.TrimSpace(*body.Description), name); err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+	}
+	if body.MFARequired != nil {
+		if _, err := tx.Exec(`UPDATE roles SET mfa_required = ? WHERE name = ?`, *body.MFARequired, name); err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+	}
+	if body.Permissions != nil {
+		if err := setRolePermissions(tx, name, *body.Permissions); err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "commit error", 500)
+		return
+	}
+	if err := s.loadRoles(); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	s.audit(r, "role.update", "role", name, before, s.roleSummary(name))
+	writeJSON(w, 200, map[string]any{"ok": true, "role": name})
+}
+
+// deleteRole removes a custom role nobody uses.
+func (s *Server) deleteRole(w http.ResponseWriter, r *http.Request, name string) {
+	var builtin bool
+	var inUse int
+	err := s.db.QueryRow(`SELECT builtin,
+		(SELECT COUNT(*) FROM users WHERE role = ?) + (SELECT COUNT(*) FROM memberships WHERE role = ?) +
+		(SELECT COUNT(*) FROM invites WHERE role = ? AND revoked_at IS NULL AND uses < max_uses)
+		FROM roles WHERE name = ?`, name, name, name, name).Scan(&builtin, &inUse)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if builtin {
+		http.Error(w, "built-in roles can't be deleted", 409)
+		return
+	}
+	if inUse > 0 {
+		http.Error(w, "role is still assigned to users, memberships or open invites", 409)
+		return
+	}
+	before := s.roleSummary(name)
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer tx.Rollback()
+	for _, stmt := range []string{
+		`DELETE FROM role_permissions WHERE role = ?`,
+		`DELETE FROM roles WHERE name = ?`,
+	} {
+		if _, err := tx.Exec(stmt, name); err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "commit error", 500)
+		return
+	}
+	if err := s.loadRoles(); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	s.audit(r, "role.delete", "role", name, before, nil)
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
+
+// ----------------------- TEAM MEMBERSHIPS -----------------------
+
+type Membership struct {
+	UserID   int64  `json:"user_id"`
+	Username string `json:"username"`
+	Team     string `json:"team"`
+	Role     string `json:"role,omitempty"` // per-team override
+}
+
+// memberships serves /api/admin/memberships: GET lists (?user_id= or
+// ?team=), POST adds or updates {user_id, team, role}, DELETE removes
+// ?user_id=&team=. role is an optional override of the user's own role for
+// that team.
+func (s *Server) memberships(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		query := `SELECT m.user_id, u.username, t.name, COALESCE(m.role, '')
+			FROM memberships m JOIN users u ON u.id = m.user_id JOIN teams t ON t.id = m.team_id WHERE 1=1`
+		var args []any
+		if v := q.Get("user_id"); v != "" {
+			query += ` AND m.user_id = ?`
+			args = append(args, v)
+		}
+		if v := q.Get("team"); v != "" {
+			query += ` AND t.name = ?`
+			args = append(args, v)
+		}
+		rows, err := s.db.Query(query+` ORDER BY t.name, u.username`, args...)
+		if err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		defer rows.Close()
+		list := []Membership{}
+		for rows.Next() {
+			var m Membership
+			if err := rows.Scan(&m.UserID, &m.Username, &m.Team, &m.Role); err != nil {
+				http.Error(w, "db error", 500)
+				return
+			}
+			list = append(list, m)
+		}
+		writeJSON(w, 200, map[string]any{"memberships": list})
+
+	case http.MethodPost:
+		var body struct {
+			UserID int64  `json:"user_id"`
+			Team   string `json:"team"`
+			Role   string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.UserID == 0 || body.Team == "" {
+			http.Error(w, "user_id and team required", 400)
+			return
+		}
+		var override any
+		if body.Role != "" {
+			if !s.validRole(body.Role) {
+				http.Error(w, "invalid role", 400)
+				return
+			}
+			if !s.canGrant(r.Context(), body.Role) {
+				http.Error(w, "you can't grant that role", 403)
+				return
+			}
+			override = body.Role
+		}
+		var teamID int64
+		err := s.db.QueryRow(`SELECT id FROM teams WHERE name = ?`, body.Team).Scan(&teamID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "team not found", 404)
+			return
+		} else if err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		if !s.mayManageUser(w, r, body.UserID) {
+			return
+		}
+		var exists int
+		s.db.QueryRow(`SELECT COUNT(*) FROM users WHERE id = ?`, body.UserID).Scan(&exists)
+		if exists == 0 {
+			http.Error(w, "user not found", 404)
+			return
+		}
+		var before any
+		var prevRole sql.NullString
+		if err := s.db.QueryRow(`SELECT role FROM memberships WHERE user_id = ? AND team_id = ?`,
+			body.UserID, teamID).Scan(&prevRole); err == nil {
+			if prevRole.String != "" && !s.canGrant(r.Context(), prevRole.String) {
+				http.Error(w, "you can't manage that membership", 403)
+				return
+			}
+			before = map[string]any{"team": body.Team, "role": prevRole.String}
+		}
+		if _, err := s.db.Exec(`INSERT INTO memberships (user_id, team_id, role) VALUES (?, ?, ?)
+			ON CONFLICT (user_id, team_id) DO UPDATE SET role = excluded.role`, body.UserID, teamID, override); err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		s.audit(r, "membership.set", "user", body.UserID, before, map[string]any{"team": body.Team, "role": body.Role})
+		writeJSON(w, 200, map[string]any{"ok": true})
+
+	case http.MethodDelete:
+		q := r.URL.Query()
+		userID, err := strconv.ParseInt(q.Get("user_id"), 10, 64)
+		if err != nil {
+			http.Error(w, "user_id and team required", 400)
+			return
+		}
+		if !s.mayManageUser(w, r, userID) {
+			return
+		}
+		var prevRole sql.NullString
+		err = s.db.QueryRow(`SELECT role FROM memberships WHERE user_id = ? AND team_id = (SELECT id FROM teams WHERE name = ?)`,
+			userID, q.Get("team")).Scan(&prevRole)
+		if err == nil && prevRole.String != "" && !s.canGrant(r.Context(), prevRole.String) {
+			http.Error(w, "you can't manage that membership", 403)
+			return
+		}
+		res, err := s.db.Exec(`DELETE FROM memberships WHERE user_id = ? AND team_id = (SELECT id FROM teams WHERE name = ?)`,
+			userID, q.Get("team"))
+		if err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "membership not found", 404)
+			return
+		}
+		s.audit(r, "membership.delete", "user", userID, map[string]any{"team": q.Get("team"), "role": prevRole.String}, nil)
+		writeJSON(w, 200, map[string]any{"ok": true})
+
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------------------- PLAYER PROFILES -----------------------
+
+// Besides the name that doubles as its folder, a player has an in-game name,
+// a role in the team (IGL, entry, support, AWPer...), the agents or
+// champions they main, a region and an active/benched status.
+//
+// roster_history keeps one row per stint on a team. A transfer closes the
+// current stint, opens one on the new team and moves the player's folder
+// there. Each VOD remembers the team it was recorded for in vods.team_id, so
+// VODs from before a transfer stay with the old team: its staff can still
+// open them, and they keep counting against its quota.
+
+var playerStatuses = []string{"active", "benched"}
+
+const (
+	maxProfileField = 40
+	maxMains        = 10
+)
+
+type PlayerProfile struct {
+	ID       int64    `json:"id"`
+	Name     string   `json:"name"`
+	TeamID   int64    `json:"team_id"`
+	Team     string   `json:"team"`
+	IGN      string   `json:"ign"`
+	GameRole string   `json:"game_role"`
+	Mains    []string `json:"mains"`
+	Region   string   `json:"region"`
+	Status   string   `json:"status"`
+	UserID   int64    `json:"user_id,omitempty"`
+}
+
+const playerColumns = `p.id, p.name, t.id, t.name, COALESCE(p.ign, ''), COALESCE(p.game_role, ''),
+	COALESCE(p.mains, '[]'), COALESCE(p.region, ''), p.status, COALESCE(p.user_id, 0)`
+
+func scanPlayerProfile(row interface{ Scan(...any) error }) (PlayerProfile, error) {
+	var p PlayerProfile
+	var mains string
+	err := row.Scan(&p.ID, &p.Name, &p.TeamID, &p.Team, &p.IGN, &p.GameRole, &mains, &p.Region, &p.Status, &p.UserID)
+	if err != nil {
+		return p, err
+	}
+	if json.Unmarshal([]byte(mains), &p.Mains) != nil || p.Mains == nil {
+		p.Mains = []string{}
+	}
+	return p, nil
+}
+
+func (s *Server) playerProfile(id int64) (PlayerProfile, error) {
+	return scanPlayerProfile(s.db.QueryRow(`SELECT `+playerColumns+` FROM players p
+		JOIN teams t ON t.id = p.team_id WHERE p.id = ?`, id))
+}
+
+func today() string { return time.Now().UTC().Format(time.DateOnly) }
+
+func parseDate(v string) (string, error) {
+	t, err := time.Parse(time.DateOnly, v)
+	if err != nil {
+		return "", fmt.Errorf("dates must look like %s", time.DateOnly)
+	}
+	return t.Format(time.DateOnly), nil
+}
+
+// parseTime accepts RFC 3339 times as well as plain dates and date-times,
+// which are taken as UTC.
+func parseTime(v string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, time.DateTime, time.DateOnly} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised time %q", v)
+}
+
+// startStint opens a roster_history row for a player joining a team.
+func startStint(db interface {
+	Exec(string, ...any) (sql.Result, error)
+}, playerID, teamID int64, date string) error {
+	_, err := db.Exec(`INSERT INTO roster_history (player_id, team_id, joined_at) VALUES (?, ?, ?)`, playerID, teamID, date)
+	return err
+}
+
+// playerPatch is the body of PATCH /api/admin/players/{id}. Fields left out
+// stay as they are; an empty string clears one.
+type playerPatch struct {
+	Name     *string   `json:"name"`
+	IGN      *string   `json:"ign"`
+	GameRole *string   `json:"game_role"`
+	Mains    *[]string `json:"mains"`
+	Region   *string   `json:"region"`
+	Status   *string   `json:"status"`
+}
+
+func (b *playerPatch) validate() error {
+	if b.Name != nil {
+		*b.Name = strings.TrimSpace(*b.Name)
+		if err := validFolderName(*b.Name); err != nil {
+			return err
+		}
+	}
+	for field, v := range map[string]*string{"ign": b.IGN, "game_role": b.GameRole, "region": b.Region} {
+		if v == nil {
+			continue
+		}
+		*v = strings.TrimSpace(*v)
+		if len(*v) > maxProfileField {
+			return fmt.Errorf("%s is too long (max %d characters)", field, maxProfileField)
+		}
+	}
+	if b.Mains != nil {
+		mains := []string{}
+		for _, m := range *b.Mains {
+			if m = strings.TrimSpace(m); m != "" && !slices.Contains(mains, m) {
+				if len(m) > maxProfileField {
+					return fmt.Errorf("mains entries are limited to %d characters", maxProfileField)
+				}
+				mains = append(mains, m)
+			}
+		}
+		if len(mains) > maxMains {
+			return fmt.Errorf("at most %d mains", maxMains)
+		}
+		*b.Mains = mains
+	}
+	if b.Status != nil && !slices.Contains(playerStatuses, *b.Status) {
+		return fmt.Errorf("status must be one of %s", strings.Join(playerStatuses, ", "))
+	}
+	return nil
+}
+
+// apply writes the profile fields (not the name) to the player's row.
+func (b *playerPatch) apply(tx *sql.Tx, id int64) error {
+	sets, args := []string{}, []any{}
+	for column, v := range map[string]*string{"ign": b.IGN, "game_role": b.GameRole, "region": b.Region} {
+		if v != nil {
+			sets, args = append(sets, column+" = ?"), append(args, nullString(*v))
+		}
+	}
+	if b.Mains != nil {
+		mains, _ := json.Marshal(*b.Mains)
+		sets, args = append(sets, "mains = ?"), append(args, string(mains))
+	}
+	if b.Status != nil {
+		sets, args = append(sets, "status = ?"), append(args, *b.Status)
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+	_, err := tx.Exec(`UPDATE players SET `+strings.Join(sets, ", ")+` WHERE id = ?`, append(args, id)...)
+	return err
+}
+
+func nullString(v string) any {
+	if v == "" {
+		return nil
+	}
+	return v
+}
+
+// updatePlayer changes a player's profile and, if the name changed, renames
+// their folder the way renamePlayer does.
+func (s *Server) updatePlayer(w http.ResponseWriter, r *http.Request, p playerRef) {
+	var body playerPatch
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	if err := body.validate(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	before, err := s.playerProfile(p.ID)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+
+	var moved int64
+	if body.Name != nil && *body.Name != p.Name {
+		n, ok := s.renamePlayer(w, r, p, *body.Name, func(tx *sql.Tx) error { return body.apply(tx, p.ID) })
+		if !ok {
+			return
+		}
+		moved = n
+	} else {
+		tx, err := s.db.Begin()
+		if err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		defer tx.Rollback()
+		if err := body.apply(tx, p.ID); err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "commit error", 500)
+			return
+		}
+	}
+
+	after, err := s.playerProfile(p.ID)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if body.IGN != nil || body.GameRole != nil || body.Mains != nil || body.Region != nil || body.Status != nil {
+		s.audit(r, "player.update", "player", p.ID, before, after)
+	}
+	writeJSON(w, 200, map[string]any{"ok": true, "player": after, "vods_moved": moved})
+}
+
+// ----------------------- ROSTER -----------------------
+
+type rosterStint struct {
+	ID       int64  `json:"id"`
+	TeamID   int64  `json:"team_id"`
+	Team     string `json:"team"`
+	JoinedAt string `json:"joined_at"`
+	LeftAt   string `json:"left_at,omitempty"`
+	VodCount int    `json:"vod_count"`
+}
+
+func (s *Server) playerHistory(playerID int64) ([]rosterStint, error) {
+	rows, err := s.db.Query(`SELECT h.id, h.team_id, COALESCE(t.name, ''), date(h.joined_at), COALESCE(date(h.left_at), ''),
+		(SELECT COUNT(*) FROM vods v WHERE v.player_id = h.player_id AND v.team_id = h.team_id)
+		FROM roster_history h LEFT JOIN teams t ON t.id = h.team_id
+		WHERE h.player_id = ? ORDER BY h.joined_at, h.id`, playerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	history := []rosterStint{}
+	for rows.Next() {
+		var h rosterStint
+		if err := rows.Scan(&h.ID, &h.TeamID, &h.Team, &h.JoinedAt, &h.LeftAt, &h.VodCount); err != nil {
+			return nil, err
+		}
+		history = append(history, h)
+	}
+	return history, rows.Err()
+}
+
+// playerDetail serves GET /api/players/{id}: the profile and roster history.
+// The vod_count of each stint is how many of the player's VODs are
+// attributed to that team.
+func (s *Server) playerDetail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", 405)
+		return
+	}
+	id, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/players"), "/"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	p, err := s.playerProfile(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "player not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if !s.requireTeam(w, r, "vods:read", p.TeamID) {
+		return
+	}
+	history, err := s.playerHistory(id)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	writeJSON(w, 200, map[string]any{"player": p, "history": history})
+}
+
+// transferPlayer moves a player to another team: POST
+// /api/admin/players/{id}/transfer with {"team_id": 3, "date": "2026-10-01"}.
+// The player's folder moves with them, but their VODs stay attributed to
+// the old team, except those added on or after a date given in the past.
+func (s *Server) transferPlayer(w http.ResponseWriter, r *http.Request, p playerRef) {
+	var body struct {
+		TeamID int64  `json:"team_id"`
+		Date   string `json:"date"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	date := today()
+	if body.Date != "" {
+		d, err := parseDate(body.Date)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if d > date {
+			http.Error(w, "date can't be in the future", 400)
+			return
+		}
+		date = d
+	}
+	if body.TeamID == p.TeamID {
+		http.Error(w, "the player is already on that team", 400)
+		return
+	}
+	var team string
+	err := s.db.QueryRow(`SELECT name FROM teams WHERE id = ?`, body.TeamID).Scan(&team)
+	if err == sql.ErrNoRows {
+		http.Error(w, "team not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	var joined string
+	s.db.QueryRow(`SELECT COALESCE(MAX(date(joined_at)), '') FROM roster_history WHERE player_id = ? AND left_at IS NULL`, p.ID).Scan(&joined)
+	if date < joined {
+		http.Error(w, "date is before the player joined their current team ("+joined+")", 400)
+		return
+	}
+
+	s.tree.Lock()
+	defer s.tree.Unlock()
+
+	var exists int
+	s.db.QueryRow(`SELECT COUNT(*) FROM players WHERE team_id = ? AND name = ?`, body.TeamID, p.Name).Scan(&exists)
+	if exists > 0 {
+		http.Error(w, "the new team already has a player with that name; rename one of them first", 409)
+		return
+	}
+
+	to := playerDir(team, p.Name)
+	m := &treeMove{ctx: r.Context()}
+	for _, st := range s.backends() {
+		if err := m.move(st, p.dir(), to, true); err != nil {
+			m.undo()
+			moveError(w, err)
+			return
+		}
+	}
+
+	var moved, reattributed int64
+	err = func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec(`UPDATE players SET team_id = ? WHERE id = ?`, body.TeamID, p.ID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE roster_history SET left_at = ? WHERE player_id = ? AND left_at IS NULL`, date, p.ID); err != nil {
+			return err
+		}
+		if err := startStint(tx, p.ID, body.TeamID, date); err != nil {
+			return err
+		}
+		if moved, err = repathVods(tx, p.dir(), to); err != nil {
+			return err
+		}
+		if body.Date != "" {
+			res, err := tx.Exec(`UPDATE vods SET team_id = ?, match_id = NULL, match_offset = NULL, offset_source = NULL WHERE player_id = ? AND team_id = ? AND COALESCE(recorded_at, created_at) >= ?`,
+				body.TeamID, p.ID, p.TeamID, date)
+			if err != nil {
+				return err
+			}
+			reattributed, _ = res.RowsAffected()
+		}
+		// A linked account follows the player onto the new team.
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO memberships (user_id, team_id)
+			SELECT user_id, ? FROM players WHERE id = ? AND user_id IS NOT NULL`, body.TeamID, p.ID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		m.undo()
+		log.Println("Transfer player error:", err)
+		http.Error(w, "db error", 500)
+		return
+	}
+
+	fmt.Printf("🔁 Transferred %s from %s to %s\n", p.Name, p.Team, team)
+	s.audit(r, "player.transfer", "player", p.ID, map[string]any{"team_id": p.TeamID, "team": p.Team},
+		map[string]any{"team_id": body.TeamID, "team": team, "date": date, "vods_reattributed": reattributed})
+	after, _ := s.playerProfile(p.ID)
+	writeJSON(w, 200, map[string]any{
+		"ok":                true,
+		"player":            after,
+		"vods_moved":        moved,
+		"vods_reattributed": reattributed,
+	})
+}
+
+// rosterHistory lets admins fill in and correct a player's past stints:
+// GET and POST /api/admin/players/{id}/history, and PATCH and DELETE
+// /api/admin/players/{id}/history/{stint}. The open stint on the current
+// team is changed by transfers, so only its join date can be edited.
+func (s *Server) rosterHistory(w http.ResponseWriter, r *http.Request, p playerRef, stint string) {
+	if stint == "" {
+		switch r.Method {
+		case http.MethodGet:
+			history, err := s.playerHistory(p.ID)
+			if err != nil {
+				http.Error(w, "db error", 500)
+				return
+			}
+			writeJSON(w, 200, map[string]any{"history": history})
+		case http.MethodPost:
+			s.addStint(w, r, p)
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+		return
+	}
+
+	id, err := strconv.ParseInt(stint, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var before rosterStint
+	var open bool
+	err = s.db.QueryRow(`SELECT h.id, h.team_id, COALESCE(t.name, ''), date(h.joined_at), COALESCE(date(h.left_at), ''),
+		h.left_at IS NULL FROM roster_history h LEFT JOIN teams t ON t.id = h.team_id WHERE h.id = ? AND h.player_id = ?`,
+		id, p.ID).Scan(&before.ID, &before.TeamID, &before.Team, &before.JoinedAt, &before.LeftAt, &open)
+	if err == sql.ErrNoRows {
+		http.Error(w, "roster entry not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodDelete:
+		if open {
+			http.Error(w, "the current stint can't be deleted; transfer the player instead", 409)
+			return
+		}
+		if _, err := s.db.Exec(`DELETE FROM roster_history WHERE id = ?`, id); err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		s.audit(r, "roster.delete", "player", p.ID, before, nil)
+		writeJSON(w, 200, map[string]any{"ok": true})
+	case http.MethodPatch:
+		var body struct {
+			JoinedAt *string `json:"joined_at"`
+			LeftAt   *string `json:"left_at"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "bad json", 400)
+			return
+		}
+		if open && body.LeftAt != nil {
+			http.Error(w, "the current stint ends with a transfer", 400)
+			return
+		}
+		after := before
+		for _, f := range []struct {
+			in  *string
+			out *string
+		}{{body.JoinedAt, &after.JoinedAt}, {body.LeftAt, &after.LeftAt}} {
+			if f.in == nil {
+				continue
+			}
+			d, err := parseDate(*f.in)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			*f.out = d
+		}
+		if err := checkStint(after.JoinedAt, after.LeftAt, open); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if _, err := s.db.Exec(`UPDATE roster_history SET joined_at = ?, left_at = ? WHERE id = ?`,
+			after.JoinedAt, nullString(after.LeftAt), id); err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		s.audit(r, "roster.update", "player", p.ID, before, after)
+		writeJSON(w, 200, map[string]any{"ok": true, "stint": after})
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
+
+func checkStint(joined, left string, open bool) error {
+	switch {
+	case joined > today():
+		return errors.New("joined_at can't be in the future")
+	case !open && left < joined:
+		return errors.New("left_at can't be before joined_at")
+	case !open && left > today():
+		return errors.New("left_at can't be in the future")
+	}
+	return nil
+}
+
+// addStint records a past stint, e.g. from before the player's VODs were
+// kept here. It takes {"team_id", "joined_at", "left_at"}, all required.
+func (s *Server) addStint(w http.ResponseWriter, r *http.Request, p playerRef) {
+	var body struct {
+		TeamID   int64  `json:"team_id"`
+		JoinedAt string `json:"joined_at"`
+		LeftAt   string `json:"left_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	joined, err := parseDate(body.JoinedAt)
+	if err != nil {
+		http.Error(w, "joined_at: "+err.Error(), 400)
+		return
+	}
+	left, err := parseDate(body.LeftAt)
+	if err != nil {
+		http.Error(w, "left_at: "+err.Error(), 400)
+		return
+	}
+	if err := checkStint(joined, left, false); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	var team string
+	err = s.db.QueryRow(`SELECT name FROM teams WHERE id = ?`, body.TeamID).Scan(&team)
+	if err == sql.ErrNoRows {
+		http.Error(w, "team not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	res, err := s.db.Exec(`INSERT INTO roster_history (player_id, team_id, joined_at, left_at) VALUES (?, ?, ?, ?)`,
+		p.ID, body.TeamID, joined, left)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	id, _ := res.LastInsertId()
+	stint := rosterStint{ID: id, TeamID: body.TeamID, Team: team, JoinedAt: joined, LeftAt: left}
+	s.audit(r, "roster.create", "player", p.ID, nil, stint)
+	writeJSON(w, 201, map[string]any{"ok": true, "stint": stint})
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// ----------------------- QUOTAS -----------------------
+
+// errQuotaExceeded is returned by quotaReader once an upload grows past
+// what is left of its team's quota.
+var errQuotaExceeded = errors.New("team storage quota exceeded")
+
+// teamQuota returns a team's quota in bytes, falling back to defaultTeamQuota
+// from config.json. Zero means unlimited.
+func (s *Server) teamQuota(teamID int64) (int64, error) {
+	var quota sql.NullInt64
+	if err := s.db.QueryRow(`SELECT quota_bytes FROM teams WHERE id = ?`, teamID).Scan(&quota); err != nil {
+		return 0, err
+	}
+	if quota.Valid {
+		return quota.Int64, nil
+	}
+	return s.defaultQuota, nil
+}
+
+// teamUsage counts what a team keeps in primary storage; archived VODs
+// don't count against the quota. db is the database or a transaction.
+func teamUsage(db interface {
+	QueryRow(string, ...any) *sql.Row
+}, teamID int64) (int64, error) {
+	var used int64
+	err := db.QueryRow(`SELECT COALESCE(SUM(v.size_bytes), 0) FROM vods v
+		WHERE v.team_id = ? AND v.archived_at IS NULL`, teamID).Scan(&used)
+	return used, err
+}
+
+// quotaWarning describes how close usage is to the quota, or "" if not close.
+func (s *Server) quotaWarning(used, quota int64) string {
+	switch {
+	case quota <= 0:
+		return ""
+	case used >= quota:
+		return "quota exceeded"
+	case used*100 >= quota*int64(s.cfg.QuotaWarnPercent):
+		return "approaching quota"
+	}
+	return ""
+}
+
+type quotaReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	q.left -= int64(n)
+	if q.left < 0 {
+		return n, errQuotaExceeded
+	}
+	return n, err
+}
+
+// setTeamQuota sets or clears (null) a team's quota, e.g. {"team": "TeamTitan", "quota": "500GB"}.
+func (s *Server) setTeamQuota(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", 405)
+		return
+	}
+	var body struct {
+		Team  string  `json:"team"`
+		Quota *string `json:"quota"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+
+	var quota any
+	if body.Quota != nil {
+		n, err := humanize.ParseBytes(*body.Quota)
+		if err != nil {
+			http.Error(w, "invalid quota, use e.g. 500GB", 400)
+			return
+		}
+		quota = int64(n)
+	}
+	var before sql.NullInt64
+	if err := s.db.QueryRow(`SELECT quota_bytes FROM teams WHERE name = ?`, strings.TrimSpace(body.Team)).Scan(&before); err == sql.ErrNoRows {
+		http.Error(w, "team not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	res, err := s.db.Exec(`UPDATE teams SET quota_bytes = ? WHERE name = ?`, quota, strings.TrimSpace(body.Team))
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "team not found", 404)
+		return
+	}
+	var prev any
+	if before.Valid {
+		prev = before.Int64
+	}
+	s.audit(r, "team.quota", "team", strings.TrimSpace(body.Team),
+		map[string]any{"quota_bytes": prev}, map[string]any{"quota_bytes": quota})
+	writeJSON(w, 200, map[string]any{"ok": true, "team": body.Team, "quota_bytes": quota})
+}
+
+// ----------------------- UPLOAD -----------------------
+
+// uploadVod stores the request body as a new VOD:
+// POST /api/vods/upload?team=TeamTitan&player=Vegard&filename=scrim1.mp4
+// An optional &recorded_at=2026-10-18T20:15:03Z says when recording started,
+// for grouping into matches; otherwise it is read from the filename.
+func (s *Server) uploadVod(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", 405)
+		return
+	}
+	q := r.URL.Query()
+	team := strings.TrimSpace(q.Get("team"))
+	player := strings.TrimSpace(q.Get("player"))
+	filename := path.Base(strings.ReplaceAll(strings.TrimSpace(q.Get("filename")), "\\", "/"))
+	if team == "" || player == "" || filename == "" || filename == "." || filename == "/" {
+		http.Error(w, "team, player and filename required", 400)
+		return
+	}
+	if !strings.HasSuffix(strings.ToLower(filename), ".mp4") {
+		http.Error(w, "only .mp4 files are accepted", 400)
+		return
+	}
+
+	recorded, err := vodRecordedAt(r, filename)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	s.tree.RLock()
+	defer s.tree.RUnlock()
+
+	var teamID, playerID int64
+	err = s.db.QueryRow(`SELECT t.id, p.id FROM players p JOIN teams t ON t.id = p.team_id
+		WHERE t.name = ? AND p.name = ?`, team, player).Scan(&teamID, &playerID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "team or player not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+
+	if !s.requireTeam(w, r, "vods:upload", teamID) {
+		return
+	}
+
+	key := path.Join("teams", team, "players", player, "vods", filename)
+	if _, err := s.store.Stat(r.Context(), key); err == nil {
+		http.Error(w, "a VOD with that name already exists", 409)
+		return
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "storage error", 500)
+		return
+	}
+
+	quota, err := s.teamQuota(teamID)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	used, err := teamUsage(s.db, teamID)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	var body io.Reader = r.Body
+	if quota > 0 {
+		if r.ContentLength > 0 && used+r.ContentLength > quota {
+			http.Error(w, errQuotaExceeded.Error(), 413)
+			return
+		}
+		body = &quotaReader{r: r.Body, left: quota - used}
+	}
+
+	counter := &countingReader{r: body}
+	if err := s.store.Put(r.Context(), key, counter, r.ContentLength); err != nil {
+		if errors.Is(err, errQuotaExceeded) {
+			http.Error(w, errQuotaExceeded.Error(), 413)
+			return
+		}
+		http.Error(w, "upload failed", 500)
+		return
+	}
+
+	// Other uploads to the team may have finished while this one streamed,
+	// so the quota is checked again with the new row in place. Inserting
+	// first takes the write lock, which makes concurrent checks take turns.
+	rel := vodFilePath(key)
+	vodID, err := s.insertUpload(teamID, quota, rel, filename, playerID, counter.n, recorded)
+	if err != nil {
+		if err := s.store.Delete(context.Background(), key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Println("Upload: could not remove", key, ":", err)
+		}
+		if errors.Is(err, errQuotaExceeded) {
+			http.Error(w, errQuotaExceeded.Error(), 413)
+		} else {
+			log.Println("Upload error:", err)
+			http.Error(w, "db error", 500)
+		}
+		return
+	}
+	s.applyVodName(vodID, filename)
+	if q.Get("recorded_at") != "" {
+		// An explicit time beats whatever the file name said.
+		s.db.Exec(`UPDATE vods SET recorded_at = ? WHERE id = ?`, recorded, vodID)
+	}
+	fmt.Println("📤 Uploaded:", rel)
+	s.audit(r, "vod.upload", "vod", vodID, nil, map[string]any{"file_path": rel, "size_bytes": counter.n})
+	s.enqueueHash(vodID)
+	s.enqueueProbe(vodID)
+	s.thumbs.enqueue(vodID)
+
+	writeJSON(w, 200, map[string]any{
+		"ok":         true,
+		"vod_id":     vodID,
+		"file_path":  rel,
+		"size_bytes": counter.n,
+		"warning":    s.quotaWarning(used+counter.n, quota),
+	})
+}
+
+// insertUpload adds the row for an uploaded VOD, unless the team is now
+// over quota, in which case it returns errQuotaExceeded.
+func (s *Server) insertUpload(teamID, quota int64, rel, title string, playerID, size int64, recorded any) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`INSERT INTO vods (file_path, title, player_id, team_id, size_bytes, recorded_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		rel, title, playerID, teamID, size, recorded)
+	if err != nil {
+		return 0, err
+	}
+	if quota > 0 {
+		used, err := teamUsage(tx, teamID)
+		if err != nil {
+			return 0, err
+		}
+		if used > quota {
+			return 0, errQuotaExceeded
+		}
+	}
+	vodID, _ := res.LastInsertId()
+	return vodID, tx.Commit()
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ----------------------- USAGE REPORT -----------------------
+
+type teamUsageRow struct {
+	TeamID     int64  `json:"team_id"`
+	TeamName   string `json:"team_name"`
+	VodCount   int    `json:"vod_count"`
+	UsedBytes  int64  `json:"used_bytes"`
+	Used       string `json:"used"`
+	QuotaBytes int64  `json:"quota_bytes"`
+	Quota      string `json:"quota,omitempty"`
+	Percent    int64  `json:"percent,omitempty"`
+	Warning    string `json:"warning,omitempty"`
+
+	ArchivedBytes int64 `json:"archived_bytes"`
+}
+
+type playerUsageRow struct {
+	PlayerID   int64  `json:"player_id"`
+	PlayerName string `json:"player_name"`
+	TeamName   string `json:"team_name"`
+	VodCount   int    `json:"vod_count"`
+	UsedBytes  int64  `json:"used_bytes"`
+	Used       string `json:"used"`
+}
+
+type monthUsageRow struct {
+	Month     string `json:"month"`
+	TeamName  string `json:"team_name"`
+	VodCount  int    `json:"vod_count"`
+	UsedBytes int64  `json:"used_bytes"`
+	Used      string `json:"used"`
+}
+
+// usage breaks stored bytes down by team, player and month. ?team_id= narrows
+// the player and month sections to one team. Archived VODs only show up as
+// each team's archived_bytes.
+func (s *Server) usage(w http.ResponseWriter, r *http.Request) {
+	teamFilter := r.URL.Query().Get("team_id")
+
+	rows, err := s.db.Query(`SELECT t.id, t.name, COUNT(v.id) - COUNT(v.archived_at),
+			COALESCE(SUM(CASE WHEN v.archived_at IS NULL THEN v.size_bytes END), 0), t.quota_bytes,
+			COALESCE(SUM(CASE WHEN v.archived_at IS NOT NULL THEN v.size_bytes END), 0)
+		FROM teams t
+		LEFT JOIN vods v ON v.team_id = t.id
+		GROUP BY t.id ORDER BY 4 DESC`)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	var total int64
+	teams := []teamUsageRow{}
+	for rows.Next() {
+		var t teamUsageRow
+		var quota sql.NullInt64
+		rows.Scan(&t.TeamID, &t.TeamName, &t.VodCount, &t.UsedBytes, &quota, &t.ArchivedBytes)
+		t.QuotaBytes = s.defaultQuota
+		if quota.Valid {
+			t.QuotaBytes = quota.Int64
+		}
+		t.Used = humanize.IBytes(uint64(t.UsedBytes))
+		if t.QuotaBytes > 0 {
+			t.Quota = humanize.IBytes(uint64(t.QuotaBytes))
+			t.Percent = t.UsedBytes * 100 / t.QuotaBytes
+			t.Warning = s.quotaWarning(t.UsedBytes, t.QuotaBytes)
+		}
+		total += t.UsedBytes
+		teams = append(teams, t)
+	}
+	rows.Close()
+
+	where, args := "", []any{}
+	if teamFilter != "" {
+		where, args = "WHERE t.id = ?", append(args, teamFilter)
+	}
+
+	rows, err = s.db.Query(`SELECT p.id, p.name, t.name, COUNT(v.id), COALESCE(SUM(v.size_bytes), 0)
+		FROM players p
+		LEFT JOIN vods v ON v.player_id = p.id AND v.archived_at IS NULL
+		JOIN teams t ON t.id = COALESCE(v.team_id, p.team_id)
+		`+where+` GROUP BY p.id, t.id ORDER BY 5 DESC`, args...)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	players := []playerUsageRow{}
+	for rows.Next() {
+		var p playerUsageRow
+		rows.Scan(&p.PlayerID, &p.PlayerName, &p.TeamName, &p.VodCount, &p.UsedBytes)
+		p.Used = humanize.IBytes(uint64(p.UsedBytes))
+		players = append(players, p)
+	}
+	rows.Close()
+
+	rows, err = s.db.Query(`SELECT strftime('%Y-%m', v.created_at), t.name, COUNT(v.id), COALESCE(SUM(v.size_bytes), 0)
+		FROM vods v
+		JOIN teams t ON t.id = v.team_id
+		WHERE v.archived_at IS NULL `+strings.Replace(where, "WHERE", "AND", 1)+` GROUP BY 1, t.id ORDER BY 1 DESC, 4 DESC`, args...)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	months := []monthUsageRow{}
+	for rows.Next() {
+		var m monthUsageRow
+		var month sql.NullString
+		rows.Scan(&month, &m.TeamName, &m.VodCount, &m.UsedBytes)
+		m.Month = month.String
+		m.Used = humanize.IBytes(uint64(m.UsedBytes))
+		months = append(months, m)
+	}
+	rows.Close()
+
+	writeJSON(w, 200, map[string]any{
+		"total_bytes": total,
+		"total":       humanize.IBytes(uint64(total)),
+		"teams":       teams,
+		"players":     players,
+		"months":      months,
+	})
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ----------------------- RETENTION RULES -----------------------
+
+// RetentionRule archives or deletes VODs older than AfterDays, counted from
+// when the VOD was recorded (see recordedAt) or, failing that, when it was
+// added. Team and Tag narrow the rule down; empty means any. Rules are
+// checked in order and the first one that applies to a VOD wins, e.g.
+//
+//	{"action": "archive", "afterDays": 90, "unlessNoted": true}
+//	{"action": "delete", "afterDays": 30, "unlessNoted": true, "tag": "warmup"}
+type RetentionRule struct {
+	Team        string `json:"team,omitempty"`
+	Tag         string `json:"tag,omitempty"`
+	Action      string `json:"action"` // "archive" or "delete"
+	AfterDays   int    `json:"afterDays"`
+	UnlessNoted bool   `json:"unlessNoted"`
+}
+
+type RetentionConfig struct {
+	Rules         []RetentionRule `json:"rules"`
+	IntervalHours int             `json:"intervalHours"` // default 24
+	Archive       StorageConfig   `json:"archive"`       // default: local "archive" directory
+}
+
+func (c RetentionConfig) validate() error {
+	for i, r := range c.Rules {
+		if r.Action != "archive" && r.Action != "delete" {
+			return fmt.Errorf("retention rule %d: action must be archive or delete", i+1)
+		}
+		if r.AfterDays <= 0 {
+			return fmt.Errorf("retention rule %d: afterDays must be positive", i+1)
+		}
+	}
+	return nil
+}
+
+type retentionAction struct {
+	VodID    int64  `json:"vod_id"`
+	FilePath string `json:"file_path"`
+	Team     string `json:"team_name"`
+	AgeDays  int    `json:"age_days"`
+	Action   string `json:"action"`
+	Rule     int    `json:"rule"` // 1-based index into retention.rules
+}
+
+// retentionPlan works out what the configured rules would do right now.
+func (s *Server) retentionPlan() ([]retentionAction, error) {
+	rules := s.cfg.Retention.Rules
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	tags := make(map[int64]map[string]bool)
+	rows, err := s.db.Query(`SELECT vod_id, tag FROM vod_tags`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int64
+		var tag string
+		rows.Scan(&id, &tag)
+		if tags[id] == nil {
+			tags[id] = make(map[string]bool)
+		}
+		tags[id][tag] = true
+	}
+	rows.Close()
+
+	rows, err = s.db.Query(`SELECT v.id, v.file_path, t.name, COALESCE(v.recorded_at, v.created_at, ''),
+			(SELECT COUNT(*) FROM notes n WHERE n.vod_id = v.id)
+		FROM vods v
+		JOIN teams t ON t.id = v.team_id
+		WHERE v.archived_at IS NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var plan []retentionAction
+	for rows.Next() {
+		var a retentionAction
+		var recorded string
+		var notes int
+		rows.Scan(&a.VodID, &a.FilePath, &a.Team, &recorded, &notes)
+		at, err := time.Parse(time.DateTime, recorded)
+		if err != nil {
+			continue
+		}
+		a.AgeDays = int(time.Since(at).Hours() / 24)
+
+		for i, rule := range rules {
+			if rule.Team != "" && rule.Team != a.Team {
+				continue
+			}
+			if rule.Tag != "" && !tags[a.VodID][rule.Tag] {
+				continue
+			}
+			if a.AgeDays < rule.AfterDays || (rule.UnlessNoted && notes > 0) {
+				continue
+			}
+			a.Action, a.Rule = rule.Action, i+1
+			plan = append(plan, a)
+			break
+		}
+	}
+	return plan, rows.Err()
+}
+
+// runRetention is the scheduled job: archives are queued as their own jobs
+// since they copy whole files, deletes happen right away.
+func (s *Server) runRetention(ctx context.Context, _ json.RawMessage) error {
+	s.tree.RLock()
+	defer s.tree.RUnlock()
+	plan, err := s.retentionPlan()
+	if err != nil {
+		return err
+	}
+	for _, a := range plan {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		switch a.Action {
+		case "archive":
+			if _, err := s.jobs.enqueue("archive", archiveJob{VodID: a.VodID}, fmt.Sprintf("archive:%d", a.VodID)); err != nil {
+				return err
+			}
+		case "delete":
+			if err := s.deleteVod(ctx, a.VodID, a.FilePath); err != nil {
+				return err
+			}
+			s.auditSystem("vod.delete", "vod", a.VodID, map[string]any{"file_path": a.FilePath},
+				map[string]any{"reason": "retention", "rule": a.Rule, "age_days": a.AgeDays})
+			fmt.Printf("🗑 Retention rule %d deleted %s (%d days old)\n", a.Rule, a.FilePath, a.AgeDays)
+		}
+	}
+	return nil
+}
+
+// scheduleRetention queues a retention run now and every intervalHours after.
+func (s *Server) scheduleRetention(ctx context.Context) {
+	if len(s.cfg.Retention.Rules) == 0 {
+		return
+	}
+	every := time.Duration(s.cfg.Retention.IntervalHours) * time.Hour
+	go func() {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			if _, err := s.jobs.enqueue("retention", struct{}{}, "retention"); err != nil {
+				log.Println("Retention queue error:", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// deleteVod removes a VOD's file, previews, notes and row.
+func (s *Server) deleteVod(ctx context.Context, vodID int64, filePath string) error {
+	if err := s.store.Delete(ctx, vodKey(filePath)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range []string{
+		`DELETE FROM notes WHERE vod_id = ?`,
+		`DELETE FROM vod_tags WHERE vod_id = ?`,
+		`DELETE FROM note_reads WHERE vod_id = ?`,
+		`DELETE FROM vods WHERE id = ?`,
+	} {
+		if _, err := tx.Exec(stmt, vodID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	os.RemoveAll(s.thumbs.dir(vodID))
+	return nil
+}
+
+// ----------------------- ARCHIVE + RESTORE -----------------------
+
+type archiveJob struct {
+	VodID int64 `json:"vod_id"`
+}
+
+// archiveVod copies a VOD into the archive backend, marks the row archived
+// and then removes the original. The row and its notes stay where they are.
+func (s *Server) archiveVod(ctx context.Context, payload json.RawMessage) error {
+	var job archiveJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return permanent(err)
+	}
+	s.tree.RLock()
+	defer s.tree.RUnlock()
+	var filePath string
+	var archivedAt sql.NullString
+	err := s.db.QueryRow(`SELECT file_path, archived_at FROM vods WHERE id = ?`, job.VodID).Scan(&filePath, &archivedAt)
+	if err == sql.ErrNoRows {
+		return permanent(err)
+	} else if err != nil {
+		return err
+	}
+	if archivedAt.Valid {
+		return nil
+	}
+
+	key := vodKey(filePath)
+	if err := copyBetween(ctx, s.store, s.archive, key); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return permanent(err)
+		}
+		return err
+	}
+	// Mark first: a scan running between these two steps would otherwise
+	// see the file gone and drop the row.
+	if _, err := s.db.Exec(`UPDATE vods SET archived_at = CURRENT_TIMESTAMP WHERE id = ?`, job.VodID); err != nil {
+		return err
+	}
+	if err := s.store.Delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	os.RemoveAll(s.thumbs.dir(job.VodID))
+	s.auditSystem("vod.archive", "vod", job.VodID, nil, map[string]any{"file_path": filePath})
+	fmt.Println("📦 Archived:", filePath)
+	return nil
+}
+
+func (s *Server) restoreVod(ctx context.Context, payload json.RawMessage) error {
+	var job archiveJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return permanent(err)
+	}
+	s.tree.RLock()
+	defer s.tree.RUnlock()
+	var filePath string
+	var archivedAt sql.NullString
+	err := s.db.QueryRow(`SELECT file_path, archived_at FROM vods WHERE id = ?`, job.VodID).Scan(&filePath, &archivedAt)
+	if err == sql.ErrNoRows {
+		return permanent(err)
+	} else if err != nil {
+		return err
+	}
+	if !archivedAt.Valid {
+		return nil
+	}
+
+	key := vodKey(filePath)
+	if err := copyBetween(ctx, s.archive, s.store, key); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return permanent(err)
+		}
+		return err
+	}
+	if _, err := s.db.Exec(`UPDATE vods SET archived_at = NULL WHERE id = ?`, job.VodID); err != nil {
+		return err
+	}
+	if err := s.archive.Delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	s.thumbs.enqueue(job.VodID)
+	s.auditSystem("vod.restore", "vod", job.VodID, nil, map[string]any{"file_path": filePath})
+	fmt.Println("📂 Restored:", filePath)
+	return nil
+}
+
+func copyBetween(ctx context.Context, from, to Storage, key string) error {
+	info, err := from.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	rc, err := from.OpenRange(ctx, key, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return to.Put(ctx, key, rc, info.Size)
+}
+
+// ----------------------- RETENTION ENDPOINTS -----------------------
+
+func (s *Server) retentionPreview(w http.ResponseWriter, r *http.Request) {
+	plan, err := s.retentionPlan()
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if plan == nil {
+		plan = []retentionAction{}
+	}
+	writeJSON(w, 200, map[string]any{"rules": s.cfg.Retention.Rules, "actions": plan})
+}
+
+func (s *Server) archiveVodHandler(w http.ResponseWriter, r *http.Request) {
+	s.queueVodJob(w, r, "archive")
+}
+
+func (s *Server) restoreVodHandler(w http.ResponseWriter, r *http.Request) {
+	s.queueVodJob(w, r, "restore")
+}
+
+func (s *Server) queueVodJob(w http.ResponseWriter, r *http.Request, typ string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", 405)
+		return
+	}
+	var body struct {
+		VodID int64 `json:"vod_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.VodID == 0 {
+		http.Error(w, "bad json", 400)
+		return
+	}
+
+	var archivedAt sql.NullString
+	err := s.db.QueryRow(`SELECT archived_at FROM vods WHERE id = ?`, body.VodID).Scan(&archivedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "vod not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if typ == "restore" && !archivedAt.Valid {
+		http.Error(w, "vod is not archived", 409)
+		return
+	}
+	if typ == "archive" && archivedAt.Valid {
+		http.Error(w, "vod is already archived", 409)
+		return
+	}
+
+	id, err := s.jobs.enqueue(typ, archiveJob{VodID: body.VodID}, fmt.Sprintf("%s:%d", typ, body.VodID))
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	s.audit(r, "vod."+typ+"_request", "vod", body.VodID, nil, map[string]any{"job_id": id})
+	writeJSON(w, 200, map[string]any{"ok": true, "job_id": id})
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------------------- S3-COMPATIBLE STORAGE -----------------------
+
+// s3Storage talks to AWS S3, MinIO or any other S3-compatible service with
+// hand-rolled SigV4 requests. Tests can point Endpoint at an httptest server
+// that fakes the handful of calls used here, or at a local MinIO.
+
+const (
+	s3PartSize     = 64 << 20 // multipart chunk size for uploads and copies
+	s3MaxSinglePut = 5 << 30  // largest object S3 accepts in a single PUT/COPY
+	s3Unsigned     = "UNSIGNED-PAYLOAD"
+)
+
+type S3Config struct {
+	Endpoint       string `json:"endpoint"` // e.g. http://localhost:9000 or https://s3.eu-north-1.amazonaws.com
+	Region         string `json:"region"`
+	Bucket         string `json:"bucket"`
+	AccessKey      string `json:"accessKey"`
+	SecretKey      string `json:"secretKey"`
+	Prefix         string `json:"prefix"`         // optional key prefix inside the bucket
+	ForcePathStyle bool   `json:"forcePathStyle"` // needed for MinIO and most self-hosted services
+}
+
+type s3Storage struct {
+	cfg    S3Config
+	base   *url.URL
+	client *http.Client
+	now    func() time.Time
+}
+
+func newS3Storage(cfg S3Config, client *http.Client) (*s3Storage, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("s3 storage needs endpoint and bucket")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	base, err := url.Parse(strings.TrimRight(cfg.Endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("s3 endpoint: %w", err)
+	}
+	if client == nil {
+		client = &http.Client{}
+	}
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+	return &s3Storage{cfg: cfg, base: base, client: client, now: time.Now}, nil
+}
+
+func (c *s3Storage) objectKey(key string) (string, error) {
+	k, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	if c.cfg.Prefix != "" {
+		k = c.cfg.Prefix + "/" + k
+	}
+	return k, nil
+}
+
+// objectURL builds the URL for an object key ("" for the bucket itself).
+func (c *s3Storage) objectURL(objKey string, query url.Values) *url.URL {
+	u := *c.base
+	if c.cfg.ForcePathStyle {
+		u.Path = "/" + c.cfg.Bucket
+		if objKey != "" {
+			u.Path += "/" + objKey
+		}
+	} else {
+		u.Host = c.cfg.Bucket + "." + u.Host
+		u.Path = "/" + objKey
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	if query != nil {
+		u.RawQuery = canonicalQuery(query)
+	}
+	return &u
+}
+
+func (c *s3Storage) do(ctx context.Context, method string, u *url.URL, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	c.sign(req, s3Unsigned)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, s3Error(resp)
+	}
+	return resp, nil
+}
+
+func s3Error(resp *http.Response) error {
+	var e struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(b, &e)
+	if e.Code == "" {
+		e.Code = resp.Status
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("s3: %s: %w", e.Code, fs.ErrNotExist)
+	}
+	return fmt.Errorf("s3: %s: %s", e.Code, e.Message)
+}
+
+func (c *s3Storage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	full := prefix
+	if c.cfg.Prefix != "" {
+		full = c.cfg.Prefix + "/" + prefix
+	}
+	var out []ObjectInfo
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {full}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := c.do(ctx, http.MethodGet, c.objectURL("", q), nil, 0, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3 list: %w", err)
+		}
+		for _, o := range page.Contents {
+			key := o.Key
+			if c.cfg.Prefix != "" {
+				key = strings.TrimPrefix(key, c.cfg.Prefix+"/")
+			}
+			if strings.HasSuffix(key, "/") {
+				continue
+			}
+			out = append(out, ObjectInfo{Key: key, Size: o.Size, ModTime: o.LastModified})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return out, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (c *s3Storage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	k, err := c.objectKey(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp, err := c.do(ctx, http.MethodHead, c.objectURL(k, nil), nil, 0, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+	mod, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return ObjectInfo{Key: key, Size: resp.ContentLength, ModTime: mod}, nil
+}
+
+func (c *s3Storage) OpenRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	k, err := c.objectKey(key)
+	if err != nil {
+		return nil, err
+	}
+	h := http.Header{}
+	switch {
+	case length == 0:
+		return io.NopCloser(strings.NewReader("")), nil
+	case length > 0:
+		h.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	case offset > 0:
+		h.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := c.do(ctx, http.MethodGet, c.objectURL(k, nil), nil, 0, h)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Put uploads in one request when the size is known and small enough, and
+// as a multipart upload otherwise.
+func (c *s3Storage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	k, err := c.objectKey(key)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && size <= s3PartSize {
+		resp, err := c.do(ctx, http.MethodPut, c.objectURL(k, nil), r, size, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	return c.multipart(ctx, k, func(part int, uploadID string) (string, bool, error) {
+		buf := make([]byte, s3PartSize)
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF && part > 1 {
+			return "", true, nil
+		}
+		last := err == io.ErrUnexpectedEOF || err == io.EOF
+		if err != nil && !last {
+			return "", false, err
+		}
+		q := url.Values{"partNumber": {strconv.Itoa(part)}, "uploadId": {uploadID}}
+		resp, err := c.do(ctx, http.MethodPut, c.objectURL(k, q), bytes.NewReader(buf[:n]), int64(n), nil)
+		if err != nil {
+			return "", false, err
+		}
+		resp.Body.Close()
+		return resp.Header.Get("ETag"), last, nil
+	})
+}
+
+// multipart runs a multipart upload, calling part for part numbers 1, 2, ...
+// until it reports done. part returns the ETag of the uploaded part, or ""
+// when it had nothing left to upload.
+func (c *s3Storage) multipart(ctx context.Context, objKey string, part func(n int, uploadID string) (etag string, done bool, err error)) error {
+	resp, err := c.do(ctx, http.MethodPost, c.objectURL(objKey, url.Values{"uploads": {""}}), nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	var init struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&init)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("s3 multipart: %w", err)
+	}
+
+	abort := func() {
+		resp, err := c.do(context.Background(), http.MethodDelete, c.objectURL(objKey, url.Values{"uploadId": {init.UploadID}}), nil, 0, nil)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+
+	type completedPart struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var parts []completedPart
+	for n := 1; ; n++ {
+		etag, done, err := part(n, init.UploadID)
+		if err != nil {
+			abort()
+			return err
+		}
+		if etag != "" {
+			parts = append(parts, completedPart{n, etag})
+		}
+		if done {
+			break
+		}
+	}
+
+	body, _ := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	resp, err = c.do(ctx, http.MethodPost, c.objectURL(objKey, url.Values{"uploadId": {init.UploadID}}),
+		bytes.NewReader(body), int64(len(body)), nil)
+	if err != nil {
+		abort()
+		return err
+	}
+	// S3 can report a failed completion with a 200 and an Error body.
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if bytes.Contains(b, []byte("<Error>")) {
+		abort()
+		return fmt.Errorf("s3 multipart complete: %s", b)
+	}
+	return nil
+}
+
+// Move copies the object server-side and deletes the original. S3 has no
+// rename, so the copy is visible briefly under both keys.
+func (c *s3Storage) Move(ctx context.Context, src, dst string) error {
+	from, err := c.objectKey(src)
+	if err != nil {
+		return err
+	}
+	to, err := c.objectKey(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := c.Stat(ctx, dst); err == nil {
+		return fmt.Errorf("%s: %w", dst, fs.ErrExist)
+	}
+	info, err := c.Stat(ctx, src)
+	if err != nil {
+		return err
+	}
+
+	source := s3Escape("/"+c.cfg.Bucket+"/"+from, false)
+	if info.Size <= s3MaxSinglePut {
+		h := http.Header{"X-Amz-Copy-Source": {source}}
+		resp, err := c.do(ctx, http.MethodPut, c.objectURL(to, nil), nil, 0, h)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	} else {
+		err := c.multipart(ctx, to, func(n int, uploadID string) (string, bool, error) {
+			start := int64(n-1) * s3PartSize
+			end := min(start+s3PartSize, info.Size) - 1
+			h := http.Header{
+				"X-Amz-Copy-Source":       {source},
+				"X-Amz-Copy-Source-Range": {fmt.Sprintf("bytes=%d-%d", start, end)},
+			}
+			q := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}}
+			resp, err := c.do(ctx, http.MethodPut, c.objectURL(to, q), nil, 0, h)
+			if err != nil {
+				return "", false, err
+			}
+			defer resp.Body.Close()
+			var res struct {
+				ETag string `xml:"ETag"`
+			}
+			if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+				return "", false, err
+			}
+			return res.ETag, end+1 >= info.Size, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return c.Delete(ctx, src)
+}
+
+func (c *s3Storage) Delete(ctx context.Context, key string) error {
+	k, err := c.objectKey(key)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, http.MethodDelete, c.objectURL(k, nil), nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// PresignGet returns a query-signed GET URL the browser can stream from
+// directly, Range requests included.
+func (c *s3Storage) PresignGet(key string, ttl time.Duration) (string, error) {
+	k, err := c.objectKey(key)
+	if err != nil {
+		return "", err
+	}
+	now := c.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + c.cfg.Region + "/s3/aws4_request"
+
+	u := c.objectURL(k, nil)
+	q := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {c.cfg.AccessKey + "/" + scope},
+		"X-Amz-Date":          {amzDate},
+		"X-Amz-Expires":       {strconv.Itoa(int(ttl.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		u.RawPath,
+		canonicalQuery(q),
+		"host:" + u.Host + "\n",
+		"host",
+		s3Unsigned,
+	}, "\n")
+	q.Set("X-Amz-Signature", c.signature(amzDate, scope, canonical))
+	u.RawQuery = canonicalQuery(q)
+	return u.String(), nil
+}
+
+// ----------------------- SIGV4 -----------------------
+
+func (c *s3Storage) sign(req *http.Request, payloadHash string) {
+	now := c.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + c.cfg.Region + "/s3/aws4_request"
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	canonical, signed := canonicalRequest(req, payloadHash)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.cfg.AccessKey, scope, signed, c.signature(amzDate, scope, canonical)))
+}
+
+// canonicalRequest is the SigV4 canonical form of req, signing the host
+// plus every x-amz-* header, and the list of headers it signs.
+func canonicalRequest(req *http.Request, payloadHash string) (canonical, signed string) {
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed = strings.Join(names, ";")
+
+	canonical = strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonHeaders.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+	return canonical, signed
+}
+
+func (c *s3Storage) signature(amzDate, scope, canonical string) string {
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.cfg.SecretKey), amzDate[:8])
+	key = hmacSHA256(key, c.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything but unreserved characters, the way
+// SigV4 expects. Slashes are kept when encodeSlash is false (object paths).
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ('A' <= ch && ch <= 'Z') || ('a' <= ch && ch <= 'z') || ('0' <= ch && ch <= '9') ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' || (ch == '/' && !encodeSlash) {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ----------------------- SESSIONS -----------------------
+
+// A session is one login on one device. The client holds a short-lived
+// access JWT carrying the session id (sid) and an opaque refresh token; only
+// the refresh token's SHA-256 is stored. Each refresh rotates the token, and
+// auth checks the session on every request so revoking it takes effect
+// immediately. Browsers may ask for both tokens as cookies instead (see
+// cookies.go).
+
+// rotationGrace is how long a just-rotated refresh token is tolerated, so two
+// tabs refreshing at the same moment don't look like token theft.
+const rotationGrace = 10 * time.Second
+
+func newSecret() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// sessionUser is what a session knows about its user, read fresh from the
+// users table on every request.
+type sessionUser struct {
+	ID                 int64
+	Username           string
+	Role               string
+	MustChangePassword bool
+	// MFAEnabled is only used to work out MFAEnrollmentRequired.
+	MFAEnabled            bool
+	MFAEnrollmentRequired bool
+}
+
+// writeTokens responds with a token pair, or with just the CSRF token when
+// the pair went into cookies.
+func (s *Server) writeTokens(w http.ResponseWriter, r *http.Request, u sessionUser, access, refresh string, cookies bool) {
+	resp := map[string]any{"expires_in": s.cfg.AccessTokenMinutes * 60}
+	if cookies {
+		resp["csrf_token"] = s.setSessionCookies(w, r, access, refresh)
+	} else {
+		resp["token"] = access
+		resp["refresh_token"] = refresh
+	}
+	if u.MustChangePassword {
+		resp["must_change_password"] = true
+	}
+	if u.MFAEnrollmentRequired {
+		resp["mfa_enrollment_required"] = true
+	}
+	writeJSON(w, 200, resp)
+}
+
+// startSession creates a session for a user who just proved who they are
+// and responds with its first token pair.
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request, u sessionUser) {
+	u.MFAEnrollmentRequired = s.mfaRequiredFor(u.Role) && !u.MFAEnabled
+	now := time.Now()
+	// Expired sessions are only kept around for a week for the session list.
+	s.db.Exec(`DELETE FROM sessions WHERE expires_at < ?`, now.Add(-7*24*time.Hour).Unix())
+
+	refresh := newSecret()
+	expires := now.Add(time.Duration(s.cfg.RefreshTokenDays) * 24 * time.Hour).Unix()
+	res, err := s.db.Exec(`INSERT INTO sessions (user_id, refresh_hash, user_agent, ip, expires_at)
+		VALUES (?, ?, ?, ?, ?)`, u.ID, hashSecret(refresh), r.UserAgent(), clientIP(r), expires)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	sid, _ := res.LastInsertId()
+	access, err := s.accessToken(u, sid)
+	if err != nil {
+		http.Error(w, "token error", 500)
+		return
+	}
+	s.writeTokens(w, r, u, access, refresh, wantsCookies(r))
+}
+
+// validSession reports whether sid is a live session of userID and returns
+// the user as it is now, so role changes apply without a new login.
+func (s *Server) validSession(sid, userID int64) (sessionUser, bool) {
+	u := sessionUser{ID: userID}
+	err := s.db.QueryRow(`SELECT u.username, u.role, u.must_change_password, u.totp_enabled_at IS NOT NULL
+		FROM sessions se JOIN users u ON u.id = se.user_id
+		WHERE se.id = ? AND se.user_id = ? AND se.revoked_at IS NULL AND se.expires_at > ?
+			AND u.disabled_at IS NULL`,
+		sid, userID, time.Now().Unix()).Scan(&u.Username, &u.Role, &u.MustChangePassword, &u.MFAEnabled)
+	u.MFAEnrollmentRequired = s.mfaRequiredFor(u.Role) && !u.MFAEnabled
+	return u, err == nil
+}
+
+func (s *Server) revokeSessions(userID int64, sessionID int64) (int64, error) {
+	q, args := `UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = ? AND revoked_at IS NULL`, []any{userID}
+	if sessionID != 0 {
+		q, args = q+` AND id = ?`, append(args, sessionID)
+	}
+	res, err := s.db.Exec(q, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ----------------------- SESSION ENDPOINTS -----------------------
+
+// refresh trades a refresh token for a new access token and a new refresh
+// token. Presenting an already rotated token revokes the whole session.
+// Cookie sessions send no body; the token comes from the refresh cookie.
+func (s *Server) refresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", 405)
+		return
+	}
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	cookies := false
+	if c, err := r.Cookie(refreshCookie); err == nil && r.ContentLength <= 0 {
+		body.RefreshToken, cookies = c.Value, true
+	} else if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.RefreshToken == "" {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	if cookies && !validCSRF(r) {
+		http.Error(w, "missing or invalid CSRF token", 403)
+		return
+	}
+	h := hashSecret(body.RefreshToken)
+	now := time.Now()
+
+	var sid, expires int64
+	var u sessionUser
+	err := s.db.QueryRow(`SELECT se.id, se.expires_at, u.id, u.username, u.role, u.must_change_password,
+			u.totp_enabled_at IS NOT NULL
+		FROM sessions se JOIN users u ON u.id = se.user_id
+		WHERE se.refresh_hash = ? AND se.revoked_at IS NULL AND u.disabled_at IS NULL`, h).
+		Scan(&sid, &expires, &u.ID, &u.Username, &u.Role, &u.MustChangePassword, &u.MFAEnabled)
+	if err == sql.ErrNoRows {
+		var reusedSid, rotatedAt int64
+		err := s.db.QueryRow(`SELECT id, rotated_at FROM sessions WHERE prev_refresh_hash = ? AND revoked_at IS NULL`, h).Scan(&reusedSid, &rotatedAt)
+		if err == nil && now.Sub(time.Unix(rotatedAt, 0)) > rotationGrace {
+			s.db.Exec(`UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE id = ?`, reusedSid)
+			log.Println("Refresh token reused, revoked session", reusedSid)
+		}
+		http.Error(w, "invalid refresh token", 401)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if expires <= now.Unix() {
+		http.Error(w, "session expired", 401)
+		return
+	}
+
+	refresh := newSecret()
+	res, err := s.db.Exec(`UPDATE sessions SET prev_refresh_hash = refresh_hash, refresh_hash = ?, rotated_at = ?,
+			last_used_at = CURRENT_TIMESTAMP, ip = ?, user_agent = ?
+		WHERE id = ? AND refresh_hash = ?`, hashSecret(refresh), now.Unix(), clientIP(r), r.UserAgent(), sid, h)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Someone else rotated it between our read and write.
+		http.Error(w, "invalid refresh token", 401)
+		return
+	}
+	u.MFAEnrollmentRequired = s.mfaRequiredFor(u.Role) && !u.MFAEnabled
+	access, err := s.accessToken(u, sid)
+	if err != nil {
+		http.Error(w, "token error", 500)
+		return
+	}
+	s.writeTokens(w, r, u, access, refresh, cookies || wantsCookies(r))
+}
+
+func (s *Server) logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", 405)
+		return
+	}
+	userID, _ := userFrom(r.Context())
+	if _, err := s.revokeSessions(userID, sessionFrom(r.Context())); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	s.audit(r, "session.logout", "session", sessionFrom(r.Context()), nil, nil)
+	s.clearSessionCookies(w, r)
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
+
+func (s *Server) logoutAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", 405)
+		return
+	}
+	userID, _ := userFrom(r.Context())
+	n, err := s.revokeSessions(userID, 0)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	s.audit(r, "session.revoke_all", "user", userID, nil, map[string]any{"revoked": n})
+	s.clearSessionCookies(w, r)
+	writeJSON(w, 200, map[string]any{"ok": true, "revoked": n})
+}
+
+type sessionRow struct {
+	ID         int64  `json:"id"`
+	UserAgent  string `json:"user_agent"`
+	IP         string `json:"ip"`
+	CreatedAt  string `json:"created_at"`
+	LastUsedAt string `json:"last_used_at"`
+	ExpiresAt  string `json:"expires_at"`
+	Current    bool   `json:"current,omitempty"`
+}
+
+func (s *Server) activeSessions(ctx context.Context, userID int64) ([]sessionRow, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, COALESCE(user_agent, ''), COALESCE(ip, ''),
+			COALESCE(created_at, ''), COALESCE(last_used_at, created_at, ''), expires_at
+		FROM sessions WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ?
+		ORDER BY COALESCE(last_used_at, created_at) DESC`, userID, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	current := sessionFrom(ctx)
+	out := []sessionRow{}
+	for rows.Next() {
+		var se sessionRow
+		var expires int64
+		rows.Scan(&se.ID, &se.UserAgent, &se.IP, &se.CreatedAt, &se.LastUsedAt, &expires)
+		se.ExpiresAt = time.Unix(expires, 0).UTC().Format(time.DateTime)
+		se.Current = se.ID == current
+		out = append(out, se)
+	}
+	return out, rows.Err()
+}
+
+// mySessions lists the caller's sessions (GET) or revokes one (DELETE ?id=).
+func (s *Server) mySessions(w http.ResponseWriter, r *http.Request) {
+	userID, _ := userFrom(r.Context())
+	switch r.Method {
+	case http.MethodGet:
+		list, err := s.activeSessions(r.Context(), userID)
+		if err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		writeJSON(w, 200, list)
+	case http.MethodDelete:
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil || id == 0 {
+			http.Error(w, "id required", 400)
+			return
+		}
+		n, err := s.revokeSessions(userID, id)
+		if err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		if n == 0 {
+			http.Error(w, "session not found", 404)
+			return
+		}
+		s.audit(r, "session.revoke", "session", id, nil, nil)
+		writeJSON(w, 200, map[string]any{"ok": true})
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
+
+func (s *Server) adminListSessions(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(r.URL.Query().Get("user_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "user_id required", 400)
+		return
+	}
+	list, err := s.activeSessions(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	writeJSON(w, 200, list)
+}
+
+// adminRevokeSessions signs a user out everywhere, or out of one session
+// when session_id is given.
+func (s *Server) adminRevokeSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", 405)
+		return
+	}
+	var body struct {
+		UserID    int64 `json:"user_id"`
+		SessionID int64 `json:"session_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.UserID == 0 {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	if !s.mayManageUser(w, r, body.UserID) {
+		return
+	}
+	n, err := s.revokeSessions(body.UserID, body.SessionID)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	fmt.Printf("🔒 Revoked %d session(s) of user %d\n", n, body.UserID)
+	s.audit(r, "session.revoke", "user", body.UserID, nil, map[string]any{"session_id": body.SessionID, "revoked": n})
+	writeJSON(w, 200, map[string]any{"ok": true, "revoked": n})
+}
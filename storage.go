@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ----------------------- STORAGE BACKENDS -----------------------
+
+// Keys are slash-separated paths relative to the storage root, for example
+// teams/TeamTitan/players/Vegard/vods/Skjermopptak1.mp4. vods.file_path keeps
+// its historic "storage/" prefix in front of the key.
+const storagePrefix = "storage/"
+
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage is where VOD files live. Missing keys are reported as errors
+// wrapping fs.ErrNotExist.
+type Storage interface {
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// OpenRange reads length bytes starting at offset; a negative length reads to the end.
+	OpenRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	// Put stores r under key. size may be -1 when unknown.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	Move(ctx context.Context, src, dst string) error
+	Delete(ctx context.Context, key string) error
+}
+
+// presigner is implemented by backends that can hand out temporary direct
+// download URLs, so video bytes don't have to pass through this server.
+type presigner interface {
+	PresignGet(key string, ttl time.Duration) (string, error)
+}
+
+// dirMaker is implemented by backends with real directories, which addTeam
+// and addPlayer create up front so people can drop files into them.
+type dirMaker interface {
+	MkdirAll(key string) error
+}
+
+// dirMover is implemented by backends with real directories. MoveDir
+// renames a whole tree in one step and fails if dst already exists;
+// RemoveDir deletes a tree and everything left in it.
+type dirMover interface {
+	MoveDir(src, dst string) error
+	RemoveDir(key string) error
+}
+
+// localPather is implemented by backends whose objects are plain files that
+// tools like ffmpeg can open directly.
+type localPather interface {
+	LocalPath(key string) (string, error)
+}
+
+type StorageConfig struct {
+	Backend string   `json:"backend"` // "local" (default) or "s3"
+	Root    string   `json:"root"`    // local backend directory, default "storage"
+	S3      S3Config `json:"s3"`
+}
+
+func newStorage(cfg StorageConfig, defaultRoot string) (Storage, error) {
+	switch cfg.Backend {
+	case "", "local":
+		root := cfg.Root
+		if root == "" {
+			root = defaultRoot
+		}
+		return &localStorage{root: root}, nil
+	case "s3":
+		return newS3Storage(cfg.S3, nil)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
+}
+
+func vodKey(filePath string) string {
+	return strings.TrimPrefix(filePath, storagePrefix)
+}
+
+func vodFilePath(key string) string {
+	return storagePrefix + key
+}
+
+// cleanKey rejects keys that would escape the storage root.
+func cleanKey(key string) (string, error) {
+	k := path.Clean("/" + strings.ReplaceAll(key, "\\", "/"))[1:]
+	if k == "" || k != strings.Trim(strings.ReplaceAll(key, "\\", "/"), "/") {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return k, nil
+}
+
+// mediaSource returns something ffmpeg can read for a key: a local path when
+// the backend has one, otherwise a short-lived presigned URL.
+func (s *Server) mediaSource(key string) (string, error) {
+	if lp, ok := s.store.(localPather); ok {
+		return lp.LocalPath(key)
+	}
+	if ps, ok := s.store.(presigner); ok {
+		return ps.PresignGet(key, 6*time.Hour)
+	}
+	return "", errors.New("storage backend can't expose files to ffmpeg")
+}
+
+// ----------------------- LOCAL FILESYSTEM -----------------------
+
+type localStorage struct {
+	root string
+}
+
+func (l *localStorage) LocalPath(key string) (string, error) {
+	k, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(l.root, filepath.FromSlash(k)), nil
+}
+
+func (l *localStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var out []ObjectInfo
+	err := filepath.Walk(l.root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if p == l.root && errors.Is(err, fs.ErrNotExist) {
+				return filepath.SkipAll
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			out = append(out, ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (l *localStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	p, err := l.LocalPath(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if info.IsDir() {
+		return ObjectInfo{}, fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+	}
+	return ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (l *localStorage) OpenRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	p, err := l.LocalPath(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+// Put writes to a temporary file next to the target and renames it into
+// place, so a half-written upload never shows up under its real name.
+func (l *localStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	p, err := l.LocalPath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, ctxReader{ctx, r})
+	if err == nil && size >= 0 && n != size {
+		err = fmt.Errorf("short write: got %d of %d bytes", n, size)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (l *localStorage) Move(ctx context.Context, src, dst string) error {
+	from, err := l.LocalPath(src)
+	if err != nil {
+		return err
+	}
+	to, err := l.LocalPath(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(to); err == nil {
+		return fmt.Errorf("%s: %w", dst, fs.ErrExist)
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+func (l *localStorage) Delete(ctx context.Context, key string) error {
+	p, err := l.LocalPath(key)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (l *localStorage) MkdirAll(key string) error {
+	p, err := l.LocalPath(key)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(p, 0755)
+}
+
+func (l *localStorage) MoveDir(src, dst string) error {
+	from, err := l.LocalPath(src)
+	if err != nil {
+		return err
+	}
+	to, err := l.LocalPath(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(from); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(to); err == nil {
+		return fmt.Errorf("%s: %w", dst, fs.ErrExist)
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+func (l *localStorage) RemoveDir(key string) error {
+	p, err := l.LocalPath(key)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+// ----------------------- SERVING -----------------------
+
+// serveVods streams /vods/<key> with Range support. Backends that can
+// presign get a redirect so the client downloads straight from them.
+func (s *Server) serveVods(w http.ResponseWriter, r *http.Request) {
+	key, err := cleanKey(strings.TrimPrefix(r.URL.Path, "/vods/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	// Files the scan hasn't picked up yet belong to no team, so only
+	// users who see every team can fetch them.
+	var vodID int64
+	err = s.db.QueryRow(`SELECT id FROM vods WHERE file_path = ?`, vodFilePath(key)).Scan(&vodID)
+	if err == sql.ErrNoRows {
+		if !s.can(r.Context(), "teams:all") {
+			http.Error(w, "forbidden", 403)
+			return
+		}
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	} else if !s.requireVod(w, r, "vods:read", vodID) {
+		return
+	}
+	if ps, ok := s.store.(presigner); ok {
+		url, err := ps.PresignGet(key, time.Hour)
+		if err != nil {
+			http.Error(w, "storage error", 500)
+			return
+		}
+		http.Redirect(w, r, url, http.StatusFound)
+		return
+	}
+
+	info, err := s.store.Stat(r.Context(), key)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, "storage error", 500)
+		return
+	}
+	rs := &rangeReader{ctx: r.Context(), store: s.store, key: key, size: info.Size}
+	defer rs.Close()
+	http.ServeContent(w, r, path.Base(key), info.ModTime, rs)
+}
+
+// rangeReader adapts OpenRange to the io.ReadSeeker http.ServeContent wants,
+// opening the object lazily at the current offset on first read.
+type rangeReader struct {
+	ctx   context.Context
+	store Storage
+	key   string
+	size  int64
+	off   int64
+	rc    io.ReadCloser
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	if r.rc == nil {
+		rc, err := r.store.OpenRange(r.ctx, r.key, r.off, -1)
+		if err != nil {
+			return 0, err
+		}
+		r.rc = rc
+	}
+	n, err := r.rc.Read(p)
+	r.off += int64(n)
+	return n, err
+}
+
+func (r *rangeReader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.off + offset
+	case io.SeekEnd:
+		abs = r.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("negative position")
+	}
+	if abs != r.off && r.rc != nil {
+		r.rc.Close()
+		r.rc = nil
+	}
+	r.off = abs
+	return abs, nil
+}
+
+func (r *rangeReader) Close() error {
+	if r.rc != nil {
+		return r.rc.Close()
+	}
+	return nil
+}
@@ -0,0 +1,754 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ----------------------- TEAM + PLAYER MANAGEMENT -----------------------
+
+// Team and player names double as folder names under storage/teams, so
+// renaming or merging one has to move files as well as rows. The files are
+// moved first; if a move fails, the ones already done are moved back, and
+// if the database update fails afterwards every move is undone. s.tree keeps
+// scans, uploads and archive jobs out while this happens.
+
+// validFolderName reports why name can't be used as a team or player name.
+func validFolderName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("name required")
+	case name == "." || name == "..":
+		return errors.New("invalid name")
+	case strings.ContainsAny(name, `/\`):
+		return errors.New("name can't contain slashes")
+	case strings.IndexFunc(name, unicode.IsControl) >= 0:
+		return errors.New("name can't contain control characters")
+	}
+	return nil
+}
+
+func teamDir(team string) string           { return path.Join("teams", team) }
+func playerDir(team, player string) string { return path.Join("teams", team, "players", player) }
+
+// backends returns every storage a VOD under teams/ may live in.
+func (s *Server) backends() []Storage {
+	if s.archive == nil {
+		return []Storage{s.store}
+	}
+	return []Storage{s.store, s.archive}
+}
+
+// treeMove moves folders between keys and remembers what it did, so the
+// whole thing can be undone.
+type treeMove struct {
+	ctx  context.Context
+	done []movedObject
+}
+
+type movedObject struct {
+	st       Storage
+	src, dst string
+	dir      bool // moved with a single MoveDir
+}
+
+// move moves everything under src to dst in st. When whole is set and the
+// backend has directories, it's one rename and dst must not exist yet.
+// Otherwise objects are moved one by one, after checking that none of them
+// would overwrite something already under dst.
+func (m *treeMove) move(st Storage, src, dst string, whole bool) error {
+	if dm, ok := st.(dirMover); ok && whole {
+		err := dm.MoveDir(src, dst)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err == nil {
+			m.done = append(m.done, movedObject{st, src, dst, true})
+		}
+		return err
+	}
+
+	objects, err := st.List(m.ctx, src+"/")
+	if err != nil {
+		return err
+	}
+	existing, err := st.List(m.ctx, dst+"/")
+	if err != nil {
+		return err
+	}
+	taken := make(map[string]bool, len(existing))
+	for _, obj := range existing {
+		taken[obj.Key] = true
+	}
+	for _, obj := range objects {
+		if to := dst + strings.TrimPrefix(obj.Key, src); taken[to] {
+			return fmt.Errorf("%s: %w", to, fs.ErrExist)
+		}
+	}
+	for _, obj := range objects {
+		to := dst + strings.TrimPrefix(obj.Key, src)
+		if err := st.Move(m.ctx, obj.Key, to); err != nil {
+			return err
+		}
+		m.done = append(m.done, movedObject{st, obj.Key, to, false})
+	}
+	return nil
+}
+
+// undo moves everything back, newest first. It keeps going past errors so
+// as much as possible ends up where it was.
+func (m *treeMove) undo() {
+	for i := len(m.done) - 1; i >= 0; i-- {
+		mv := m.done[i]
+		var err error
+		if mv.dir {
+			err = mv.st.(dirMover).MoveDir(mv.dst, mv.src)
+		} else {
+			err = mv.st.Move(context.Background(), mv.dst, mv.src)
+		}
+		if err != nil {
+			log.Println("Rollback: could not move", mv.dst, "back to", mv.src, ":", err)
+		}
+	}
+	m.done = nil
+}
+
+// removeDirs deletes what's left of a folder once its contents are gone,
+// on backends that have directories.
+func (s *Server) removeDirs(key string) {
+	for _, st := range s.backends() {
+		if dm, ok := st.(dirMover); ok {
+			if err := dm.RemoveDir(key); err != nil {
+				log.Println("Could not remove", key, ":", err)
+			}
+		}
+	}
+}
+
+// repathVods points every VOD under the old folder at the new one.
+func repathVods(tx *sql.Tx, from, to string) (int64, error) {
+	oldPrefix, newPrefix := vodFilePath(from+"/"), vodFilePath(to+"/")
+	res, err := tx.Exec(`UPDATE vods SET file_path = ? || substr(file_path, length(?) + 1)
+		WHERE substr(file_path, 1, length(?)) = ?`, newPrefix, oldPrefix, oldPrefix, oldPrefix)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// mergePlayerRows hands a player's VODs to another and deletes it. The
+// account link carries over unless the target already has one.
+func mergePlayerRows(tx *sql.Tx, from, into int64) error {
+	for _, stmt := range []string{
+		`UPDATE vods SET player_id = ? WHERE player_id = ?`,
+		`UPDATE players SET user_id = (SELECT user_id FROM players WHERE id = ?2) WHERE id = ?1 AND user_id IS NULL`,
+		`UPDATE invites SET player_id = ? WHERE player_id = ?`,
+		`UPDATE roster_history SET player_id = ? WHERE player_id = ?`,
+	} {
+		if _, err := tx.Exec(stmt, into, from); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(`DELETE FROM players WHERE id = ?`, from)
+	return err
+}
+
+// moveError answers a failed treeMove: a name clash is the caller's problem,
+// anything else is ours.
+func moveError(w http.ResponseWriter, err error) {
+	if errors.Is(err, fs.ErrExist) {
+		http.Error(w, "something is already stored under the new name: "+err.Error(), 409)
+		return
+	}
+	log.Println("Move error:", err)
+	http.Error(w, "storage error", 500)
+}
+
+// retentionWarning notes retention rules that still name a team after it
+// was renamed or merged away; they live in the config file, not the database.
+func (s *Server) retentionWarning(team string) string {
+	for _, rule := range s.cfg.Retention.Rules {
+		if rule.Team == team {
+			return fmt.Sprintf("retention rules in the config still refer to %q", team)
+		}
+	}
+	return ""
+}
+
+// adminItem splits /api/admin/<kind>/<id>[/<action>].
+func adminItem(r *http.Request, prefix string) (int64, string, error) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	idPart, action, _ := strings.Cut(rest, "/")
+	id, err := strconv.ParseInt(idPart, 10, 64)
+	return id, action, err
+}
+
+// ----------------------- TEAM ENDPOINTS -----------------------
+
+// teamsAdmin serves PATCH and DELETE /api/admin/teams/{id} and
+// POST /api/admin/teams/{id}/merge.
+func (s *Server) teamsAdmin(w http.ResponseWriter, r *http.Request) {
+	id, action, err := adminItem(r, "/api/admin/teams")
+	if err != nil {
+		http.Error(w, "invalid team id", 400)
+		return
+	}
+	var name string
+	err = s.db.QueryRow(`SELECT name FROM teams WHERE id = ?`, id).Scan(&name)
+	if err == sql.ErrNoRows {
+		http.Error(w, "team not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodPatch:
+		s.renameTeam(w, r, id, name)
+	case action == "" && r.Method == http.MethodDelete:
+		s.deleteTeam(w, r, id, name)
+	case action == "merge" && r.Method == http.MethodPost:
+		s.mergeTeam(w, r, id, name)
+	case action == "" || action == "merge":
+		http.Error(w, "method not allowed", 405)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) renameTeam(w http.ResponseWriter, r *http.Request, id int64, oldName string) {
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	newName := strings.TrimSpace(body.Name)
+	if err := validFolderName(newName); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if newName == oldName {
+		writeJSON(w, 200, map[string]any{"ok": true, "team": newName, "vods_moved": 0})
+		return
+	}
+
+	s.tree.Lock()
+	defer s.tree.Unlock()
+
+	var exists int
+	s.db.QueryRow(`SELECT COUNT(*) FROM teams WHERE name = ?`, newName).Scan(&exists)
+	if exists > 0 {
+		http.Error(w, "a team with that name already exists; merge into it instead", 409)
+		return
+	}
+
+	m := &treeMove{ctx: r.Context()}
+	for _, st := range s.backends() {
+		if err := m.move(st, teamDir(oldName), teamDir(newName), true); err != nil {
+			m.undo()
+			moveError(w, err)
+			return
+		}
+	}
+
+	moved, err := func() (int64, error) {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return 0, err
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec(`UPDATE teams SET name = ? WHERE id = ?`, newName, id); err != nil {
+			return 0, err
+		}
+		n, err := repathVods(tx, teamDir(oldName), teamDir(newName))
+		if err != nil {
+			return 0, err
+		}
+		return n, tx.Commit()
+	}()
+	if err != nil {
+		m.undo()
+		log.Println("Rename team error:", err)
+		http.Error(w, "db error", 500)
+		return
+	}
+
+	fmt.Printf("✏️ Renamed team %s to %s (%d VODs)\n", oldName, newName, moved)
+	s.audit(r, "team.rename", "team", id, map[string]any{"name": oldName}, map[string]any{"name": newName, "vods_moved": moved})
+	writeJSON(w, 200, map[string]any{
+		"ok":         true,
+		"team":       newName,
+		"vods_moved": moved,
+		"warning":    s.retentionWarning(oldName),
+	})
+}
+
+// mergeTeam moves every player, VOD, membership and invite of one team into
+// another and deletes the emptied team. Players with the same name in both
+// teams become one player.
+func (s *Server) mergeTeam(w http.ResponseWriter, r *http.Request, fromID int64, fromName string) {
+	var body struct {
+		IntoID int64 `json:"into_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	if body.IntoID == fromID {
+		http.Error(w, "can't merge a team into itself", 400)
+		return
+	}
+	var intoName string
+	err := s.db.QueryRow(`SELECT name FROM teams WHERE id = ?`, body.IntoID).Scan(&intoName)
+	if err == sql.ErrNoRows {
+		http.Error(w, "target team not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+
+	s.tree.Lock()
+	defer s.tree.Unlock()
+
+	m := &treeMove{ctx: r.Context()}
+	for _, st := range s.backends() {
+		if err := m.move(st, teamDir(fromName), teamDir(intoName), false); err != nil {
+			m.undo()
+			moveError(w, err)
+			return
+		}
+	}
+
+	var moved, playersMerged int64
+	err = func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		rows, err := tx.Query(`SELECT p.id, (SELECT q.id FROM players q WHERE q.team_id = ? AND q.name = p.name)
+			FROM players p WHERE p.team_id = ?`, body.IntoID, fromID)
+		if err != nil {
+			return err
+		}
+		same := map[int64]int64{}
+		for rows.Next() {
+			var id int64
+			var match sql.NullInt64
+			if err := rows.Scan(&id, &match); err != nil {
+				rows.Close()
+				return err
+			}
+			if match.Valid {
+				same[id] = match.Int64
+			}
+		}
+		rows.Close()
+		for from, into := range same {
+			if err := mergePlayerRows(tx, from, into); err != nil {
+				return err
+			}
+		}
+		playersMerged = int64(len(same))
+
+		for _, stmt := range []string{
+			`UPDATE players SET team_id = ? WHERE team_id = ?`,
+			`INSERT OR IGNORE INTO memberships (user_id, team_id, role)
+				SELECT user_id, ?, role FROM memberships WHERE team_id = ?`,
+			`UPDATE invites SET team_id = ? WHERE team_id = ?`,
+			`UPDATE vods SET team_id = ? WHERE team_id = ?`,
+			`UPDATE roster_history SET team_id = ? WHERE team_id = ?`,
+			`UPDATE matches SET team_id = ? WHERE team_id = ?`,
+		} {
+			if _, err := tx.Exec(stmt, body.IntoID, fromID); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(`DELETE FROM memberships WHERE team_id = ?`, fromID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM teams WHERE id = ?`, fromID); err != nil {
+			return err
+		}
+		if moved, err = repathVods(tx, teamDir(fromName), teamDir(intoName)); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		m.undo()
+		log.Println("Merge team error:", err)
+		http.Error(w, "db error", 500)
+		return
+	}
+	s.removeDirs(teamDir(fromName))
+
+	fmt.Printf("🔀 Merged team %s into %s (%d VODs)\n", fromName, intoName, moved)
+	s.audit(r, "team.merge", "team", body.IntoID, map[string]any{"merged_team_id": fromID, "merged_team": fromName},
+		map[string]any{"name": intoName, "vods_moved": moved, "players_merged": playersMerged})
+	writeJSON(w, 200, map[string]any{
+		"ok":             true,
+		"team":           intoName,
+		"vods_moved":     moved,
+		"players_merged": playersMerged,
+		"warning":        s.retentionWarning(fromName),
+	})
+}
+
+// deleteTeam removes a team with its players, memberships, invites and matches.
+// A team that still has VODs is only deleted with ?delete_vods=true, which
+// removes the VODs, their notes and their files too.
+func (s *Server) deleteTeam(w http.ResponseWriter, r *http.Request, id int64, name string) {
+	s.tree.Lock()
+	defer s.tree.Unlock()
+
+	// Players go with the team, so footage they recorded for other teams
+	// would go too. Those players have to be transferred out first.
+	var foreign int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM vods v JOIN players p ON p.id = v.player_id
+		WHERE p.team_id = ?1 AND v.team_id IS NOT NULL AND v.team_id != ?1`, id).Scan(&foreign); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if foreign > 0 {
+		http.Error(w, fmt.Sprintf("%d VODs of this team's players belong to other teams; transfer those players out first", foreign), 409)
+		return
+	}
+	vods, ok := s.vodsWhere(w, r, `COALESCE(v.team_id, p.team_id) = ?`, id)
+	if !ok {
+		return
+	}
+	err := s.deleteRows(vods, func(tx *sql.Tx) error {
+		for _, stmt := range []string{
+			`DELETE FROM roster_history WHERE team_id = ? OR player_id IN (SELECT id FROM players WHERE team_id = ?1)`,
+			`DELETE FROM players WHERE team_id = ?`,
+			`DELETE FROM memberships WHERE team_id = ?`,
+			`DELETE FROM invites WHERE team_id = ?`,
+			`DELETE FROM match_notes WHERE match_id IN (SELECT id FROM matches WHERE team_id = ?)`,
+			`DELETE FROM matches WHERE team_id = ?`,
+			`DELETE FROM teams WHERE id = ?`,
+		} {
+			if _, err := tx.Exec(stmt, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Delete team error:", err)
+		http.Error(w, "db error", 500)
+		return
+	}
+	leftover := s.deleteFiles(r.Context(), vods, teamDir(name))
+
+	fmt.Printf("🗑 Deleted team %s (%d VODs)\n", name, len(vods))
+	s.audit(r, "team.delete", "team", id, map[string]any{"name": name},
+		map[string]any{"vods_deleted": len(vods), "files_not_removed": leftover})
+	writeJSON(w, 200, map[string]any{
+		"ok":                true,
+		"vods_deleted":      len(vods),
+		"files_not_removed": leftover,
+	})
+}
+
+// ----------------------- PLAYER ENDPOINTS -----------------------
+
+// playersAdmin serves PATCH and DELETE /api/admin/players/{id}, and POST
+// /api/admin/players/{id}/merge, /link and /transfer, and the roster
+// history under /api/admin/players/{id}/history.
+func (s *Server) playersAdmin(w http.ResponseWriter, r *http.Request) {
+	id, action, err := adminItem(r, "/api/admin/players")
+	if err != nil {
+		http.Error(w, "invalid player id", 400)
+		return
+	}
+	var p playerRef
+	err = s.db.QueryRow(`SELECT p.id, p.name, t.id, t.name FROM players p JOIN teams t ON t.id = p.team_id
+		WHERE p.id = ?`, id).Scan(&p.ID, &p.Name, &p.TeamID, &p.Team)
+	if err == sql.ErrNoRows {
+		http.Error(w, "player not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodPatch:
+		s.updatePlayer(w, r, p)
+	case action == "" && r.Method == http.MethodDelete:
+		s.deletePlayer(w, r, p)
+	case action == "merge" && r.Method == http.MethodPost:
+		s.mergePlayer(w, r, p)
+	case action == "link" && r.Method == http.MethodPost:
+		s.linkPlayer(w, r, p)
+	case action == "transfer" && r.Method == http.MethodPost:
+		s.transferPlayer(w, r, p)
+	case action == "history" || strings.HasPrefix(action, "history/"):
+		s.rosterHistory(w, r, p, strings.TrimPrefix(strings.TrimPrefix(action, "history"), "/"))
+	case action == "" || action == "merge" || action == "link" || action == "transfer":
+		http.Error(w, "method not allowed", 405)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type playerRef struct {
+	ID     int64  `json:"id"`
+	Name   string `json:"name"`
+	TeamID int64  `json:"team_id"`
+	Team   string `json:"team"`
+}
+
+func (p playerRef) dir() string { return playerDir(p.Team, p.Name) }
+
+// renamePlayer moves a player's folder to newName and updates the rows to
+// match, running also in the same transaction. It answers failures itself
+// and reports whether the rename went through.
+func (s *Server) renamePlayer(w http.ResponseWriter, r *http.Request, p playerRef, newName string,
+	also func(*sql.Tx) error) (int64, bool) {
+	s.tree.Lock()
+	defer s.tree.Unlock()
+
+	var exists int
+	s.db.QueryRow(`SELECT COUNT(*) FROM players WHERE team_id = ? AND name = ?`, p.TeamID, newName).Scan(&exists)
+	if exists > 0 {
+		http.Error(w, "the team already has a player with that name; merge into it instead", 409)
+		return 0, false
+	}
+
+	to := playerDir(p.Team, newName)
+	m := &treeMove{ctx: r.Context()}
+	for _, st := range s.backends() {
+		if err := m.move(st, p.dir(), to, true); err != nil {
+			m.undo()
+			moveError(w, err)
+			return 0, false
+		}
+	}
+
+	moved, err := func() (int64, error) {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return 0, err
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec(`UPDATE players SET name = ? WHERE id = ?`, newName, p.ID); err != nil {
+			return 0, err
+		}
+		n, err := repathVods(tx, p.dir(), to)
+		if err != nil {
+			return 0, err
+		}
+		if err := also(tx); err != nil {
+			return 0, err
+		}
+		return n, tx.Commit()
+	}()
+	if err != nil {
+		m.undo()
+		log.Println("Rename player error:", err)
+		http.Error(w, "db error", 500)
+		return 0, false
+	}
+
+	fmt.Printf("✏️ Renamed player %s/%s to %s (%d VODs)\n", p.Team, p.Name, newName, moved)
+	s.audit(r, "player.rename", "player", p.ID, map[string]any{"name": p.Name, "team": p.Team},
+		map[string]any{"name": newName, "vods_moved": moved})
+	return moved, true
+}
+
+// mergePlayer moves one player's VODs to another player, in the same team or
+// a different one, and deletes the emptied player.
+func (s *Server) mergePlayer(w http.ResponseWriter, r *http.Request, from playerRef) {
+	var body struct {
+		IntoID int64 `json:"into_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	if body.IntoID == from.ID {
+		http.Error(w, "can't merge a player into itself", 400)
+		return
+	}
+	var into playerRef
+	err := s.db.QueryRow(`SELECT p.id, p.name, t.id, t.name FROM players p JOIN teams t ON t.id = p.team_id
+		WHERE p.id = ?`, body.IntoID).Scan(&into.ID, &into.Name, &into.TeamID, &into.Team)
+	if err == sql.ErrNoRows {
+		http.Error(w, "target player not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+
+	s.tree.Lock()
+	defer s.tree.Unlock()
+
+	m := &treeMove{ctx: r.Context()}
+	for _, st := range s.backends() {
+		if err := m.move(st, from.dir(), into.dir(), false); err != nil {
+			m.undo()
+			moveError(w, err)
+			return
+		}
+	}
+
+	moved, err := func() (int64, error) {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return 0, err
+		}
+		defer tx.Rollback()
+		if err := mergePlayerRows(tx, from.ID, into.ID); err != nil {
+			return 0, err
+		}
+		n, err := repathVods(tx, from.dir(), into.dir())
+		if err != nil {
+			return 0, err
+		}
+		return n, tx.Commit()
+	}()
+	if err != nil {
+		m.undo()
+		log.Println("Merge player error:", err)
+		http.Error(w, "db error", 500)
+		return
+	}
+	s.removeDirs(from.dir())
+
+	fmt.Printf("🔀 Merged player %s/%s into %s/%s (%d VODs)\n", from.Team, from.Name, into.Team, into.Name, moved)
+	s.audit(r, "player.merge", "player", into.ID, map[string]any{"merged_player": from}, map[string]any{"vods_moved": moved})
+	writeJSON(w, 200, map[string]any{"ok": true, "player": into, "vods_moved": moved})
+}
+
+// deletePlayer removes a player; like deleteTeam it needs ?delete_vods=true
+// if the player still has VODs.
+func (s *Server) deletePlayer(w http.ResponseWriter, r *http.Request, p playerRef) {
+	s.tree.Lock()
+	defer s.tree.Unlock()
+
+	vods, ok := s.vodsWhere(w, r, `v.player_id = ?`, p.ID)
+	if !ok {
+		return
+	}
+	err := s.deleteRows(vods, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM roster_history WHERE player_id = ?`, p.ID); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`DELETE FROM players WHERE id = ?`, p.ID)
+		return err
+	})
+	if err != nil {
+		log.Println("Delete player error:", err)
+		http.Error(w, "db error", 500)
+		return
+	}
+	leftover := s.deleteFiles(r.Context(), vods, p.dir())
+
+	fmt.Printf("🗑 Deleted player %s/%s (%d VODs)\n", p.Team, p.Name, len(vods))
+	s.audit(r, "player.delete", "player", p.ID, map[string]any{"name": p.Name, "team": p.Team},
+		map[string]any{"vods_deleted": len(vods), "files_not_removed": leftover})
+	writeJSON(w, 200, map[string]any{
+		"ok":                true,
+		"vods_deleted":      len(vods),
+		"files_not_removed": leftover,
+	})
+}
+
+// ----------------------- DELETION HELPERS -----------------------
+
+type vodFile struct {
+	ID       int64
+	FilePath string
+	Archived bool
+}
+
+// vodsWhere lists the VODs a delete would take with it, and refuses with 409
+// when there are some and the request didn't ask for them to go too.
+func (s *Server) vodsWhere(w http.ResponseWriter, r *http.Request, cond string, args ...any) ([]vodFile, bool) {
+	rows, err := s.db.Query(`SELECT v.id, v.file_path, v.archived_at IS NOT NULL
+		FROM vods v JOIN players p ON p.id = v.player_id WHERE `+cond, args...)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return nil, false
+	}
+	defer rows.Close()
+	var vods []vodFile
+	for rows.Next() {
+		var v vodFile
+		if err := rows.Scan(&v.ID, &v.FilePath, &v.Archived); err != nil {
+			http.Error(w, "db error", 500)
+			return nil, false
+		}
+		vods = append(vods, v)
+	}
+	if len(vods) > 0 && r.URL.Query().Get("delete_vods") != "true" {
+		http.Error(w, fmt.Sprintf("%d VODs would be deleted; pass delete_vods=true to confirm", len(vods)), 409)
+		return nil, false
+	}
+	return vods, true
+}
+
+// deleteRows removes the VODs' notes, tags and rows, then whatever else
+// runs in one transaction.
+func (s *Server) deleteRows(vods []vodFile, rest func(*sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, v := range vods {
+		for _, stmt := range []string{
+			`DELETE FROM notes WHERE vod_id = ?`,
+			`DELETE FROM vod_tags WHERE vod_id = ?`,
+			`DELETE FROM note_reads WHERE vod_id = ?`,
+			`DELETE FROM vods WHERE id = ?`,
+		} {
+			if _, err := tx.Exec(stmt, v.ID); err != nil {
+				return err
+			}
+		}
+	}
+	if err := rest(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteFiles removes the files of VODs whose rows are already gone, then
+// the folder they were in. As with duplicate merging, a file that can't be
+// removed would come back as a new VOD on the next scan, so it's reported.
+func (s *Server) deleteFiles(ctx context.Context, vods []vodFile, dir string) []string {
+	leftover := []string{}
+	for _, v := range vods {
+		st := s.store
+		if v.Archived && s.archive != nil {
+			st = s.archive
+		}
+		if err := st.Delete(ctx, vodKey(v.FilePath)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Println("Delete: could not remove", v.FilePath, ":", err)
+			leftover = append(leftover, v.FilePath)
+		}
+		os.RemoveAll(s.thumbs.dir(v.ID))
+	}
+	s.removeDirs(dir)
+	return leftover
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------------------- FRAME EXTRACTION -----------------------
+
+// FrameExtractor pulls still images out of a video. The server uses the
+// ffmpeg-backed implementation; tests can plug in a stub that writes fixed JPEGs.
+type FrameExtractor interface {
+	Duration(ctx context.Context, src string) (float64, error)
+	ExtractFrame(ctx context.Context, src string, at float64, width int, dst string) error
+}
+
+type ffmpegExtractor struct {
+	ffmpeg  string
+	ffprobe string
+}
+
+func (e *ffmpegExtractor) Duration(ctx context.Context, src string) (float64, error) {
+	out, err := exec.CommandContext(ctx, e.ffprobe, "-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1", src).Output()
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe: %w", err)
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+}
+
+func (e *ffmpegExtractor) ExtractFrame(ctx context.Context, src string, at float64, width int, dst string) error {
+	cmd := exec.CommandContext(ctx, e.ffmpeg, "-v", "error", "-y",
+		"-ss", strconv.FormatFloat(at, 'f', 3, 64), "-i", src,
+		"-frames:v", "1", "-vf", fmt.Sprintf("scale=%d:-2", width), "-q:v", "4", dst)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// ----------------------- THUMBNAIL JOBS -----------------------
+
+const (
+	posterWidth     = 480
+	spriteTileWidth = 160
+	spriteColumns   = 10
+	spriteInterval  = 10.0 // seconds between scrub frames
+	spriteMaxFrames = 100
+	thumbRetryAfter = 10 * time.Minute
+)
+
+type thumbnailer struct {
+	s         *Server
+	extractor FrameExtractor
+}
+
+func newThumbnailer(s *Server, extractor FrameExtractor) *thumbnailer {
+	return &thumbnailer{s: s, extractor: extractor}
+}
+
+// enqueue schedules preview generation for a VOD, unless it is already
+// queued or failed recently.
+func (t *thumbnailer) enqueue(vodID int64) {
+	key := fmt.Sprintf("thumbnails:%d", vodID)
+	if t.s.jobs.recentlyFailed(key, thumbRetryAfter) {
+		return
+	}
+	if _, err := t.s.jobs.enqueue("thumbnails", thumbnailJob{VodID: vodID}, key); err != nil {
+		log.Println("Thumbnail queue error:", err)
+	}
+}
+
+// enqueueMissing queues every VOD that doesn't have a full set of previews yet.
+func (t *thumbnailer) enqueueMissing() {
+	rows, err := t.s.db.Query(`SELECT id FROM vods ORDER BY id DESC`)
+	if err != nil {
+		log.Println("Thumbnail queue error:", err)
+		return
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		rows.Scan(&id)
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if _, err := os.Stat(filepath.Join(t.dir(id), "sprite.vtt")); os.IsNotExist(err) {
+			t.enqueue(id)
+		}
+	}
+}
+
+type thumbnailJob struct {
+	VodID int64 `json:"vod_id"`
+}
+
+func (t *thumbnailer) handle(ctx context.Context, payload json.RawMessage) error {
+	var job thumbnailJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return permanent(err)
+	}
+	err := t.generate(ctx, job.VodID)
+	if errors.Is(err, sql.ErrNoRows) || errors.Is(err, fs.ErrNotExist) {
+		return permanent(err)
+	}
+	return err
+}
+
+func (t *thumbnailer) dir(vodID int64) string {
+	return filepath.Join(t.s.cfg.DerivedDir, "vods", strconv.FormatInt(vodID, 10))
+}
+
+// generate writes poster.jpg, sprite.jpg and sprite.vtt for a VOD. Assets
+// newer than the source video are kept as they are.
+func (t *thumbnailer) generate(ctx context.Context, vodID int64) error {
+	var filePath string
+	if err := t.s.db.QueryRow(`SELECT file_path FROM vods WHERE id = ?`, vodID).Scan(&filePath); err != nil {
+		return err
+	}
+	key := vodKey(filePath)
+	src, err := t.s.store.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	dir := t.dir(vodID)
+	if info, err := os.Stat(filepath.Join(dir, "sprite.vtt")); err == nil && !info.ModTime().Before(src.ModTime) {
+		return nil
+	}
+
+	input, err := t.s.mediaSource(key)
+	if err != nil {
+		return err
+	}
+	dur, err := t.extractor.Duration(ctx, input)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(t.s.cfg.DerivedDir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(t.s.cfg.DerivedDir, "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := t.extractor.ExtractFrame(ctx, input, min(dur/10, 30), posterWidth, filepath.Join(tmp, "poster.jpg")); err != nil {
+		return err
+	}
+	if err := t.buildSprite(ctx, input, dur, tmp); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// sprite.vtt goes last since its timestamp marks the set as complete
+	for _, name := range []string{"poster.jpg", "sprite.jpg", "sprite.vtt"} {
+		if err := os.Rename(filepath.Join(tmp, name), filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	fmt.Println("🖼 Generated previews for VOD", vodID)
+	return nil
+}
+
+// buildSprite grabs a frame every spriteInterval seconds (spread wider for
+// long videos), tiles them into sprite.jpg and indexes the tiles in sprite.vtt.
+func (t *thumbnailer) buildSprite(ctx context.Context, src string, dur float64, tmp string) error {
+	interval := spriteInterval
+	if dur/interval > spriteMaxFrames {
+		interval = dur / spriteMaxFrames
+	}
+
+	var frames []image.Image
+	var times []float64
+	for at := 0.0; at < dur; at += interval {
+		p := filepath.Join(tmp, fmt.Sprintf("frame-%03d.jpg", len(frames)))
+		if err := t.extractor.ExtractFrame(ctx, src, at, spriteTileWidth, p); err != nil {
+			return err
+		}
+		img, err := decodeJPEG(p)
+		if err != nil {
+			return err
+		}
+		frames = append(frames, img)
+		times = append(times, at)
+	}
+	if len(frames) == 0 {
+		return errors.New("video has no frames")
+	}
+
+	tile := frames[0].Bounds().Size()
+	cols := min(spriteColumns, len(frames))
+	rows := (len(frames) + cols - 1) / cols
+	sheet := image.NewRGBA(image.Rect(0, 0, cols*tile.X, rows*tile.Y))
+
+	var vtt strings.Builder
+	vtt.WriteString("WEBVTT\n\n")
+	for i, img := range frames {
+		x, y := (i%cols)*tile.X, (i/cols)*tile.Y
+		draw.Draw(sheet, image.Rect(x, y, x+tile.X, y+tile.Y), img, img.Bounds().Min, draw.Src)
+		fmt.Fprintf(&vtt, "%s --> %s\nsprite.jpg#xywh=%d,%d,%d,%d\n\n",
+			vttTime(times[i]), vttTime(min(times[i]+interval, dur)), x, y, tile.X, tile.Y)
+	}
+
+	f, err := os.Create(filepath.Join(tmp, "sprite.jpg"))
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(f, sheet, &jpeg.Options{Quality: 75}); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(tmp, "sprite.vtt"), []byte(vtt.String()), 0644)
+}
+
+func decodeJPEG(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return jpeg.Decode(f)
+}
+
+func vttTime(seconds float64) string {
+	d := time.Duration(seconds * float64(time.Second))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d",
+		int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60, d.Milliseconds()%1000)
+}
+
+// ----------------------- DERIVED ASSETS -----------------------
+
+// derivedAssets serves generated previews, e.g. vods/42/poster.jpg. Asking
+// for a preview that doesn't exist yet queues its generation and returns 404.
+func (s *Server) derivedAssets() http.Handler {
+	files := http.FileServer(http.Dir(s.cfg.DerivedDir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only vods/<id>/<file>, so access can be checked per VOD.
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) != 3 || parts[0] != "vods" {
+			http.NotFound(w, r)
+			return
+		}
+		id, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if !s.requireVod(w, r, "vods:read", id) {
+			return
+		}
+		if _, err := os.Stat(filepath.Join(s.thumbs.dir(id), parts[2])); os.IsNotExist(err) {
+			s.thumbs.enqueue(id)
+			http.NotFound(w, r)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// fakeExtractor stands in for ffmpeg: every frame is a solid tile of the
+// requested width, and the calls are recorded.
+type fakeExtractor struct {
+	duration float64
+
+	mu     sync.Mutex
+	srcs   []string
+	frames []float64
+}
+
+func (f *fakeExtractor) Duration(ctx context.Context, src string) (float64, error) {
+	return f.duration, nil
+}
+
+func (f *fakeExtractor) ExtractFrame(ctx context.Context, src string, at float64, width int, dst string) error {
+	f.mu.Lock()
+	f.srcs, f.frames = append(f.srcs, src), append(f.frames, at)
+	f.mu.Unlock()
+	img := image.NewRGBA(image.Rect(0, 0, width, width*9/16))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(at)
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return jpeg.Encode(out, img, nil)
+}
+
+func newThumbTestServer(t *testing.T) (*Server, string) {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := sql.Open("sqlite", filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(`CREATE TABLE vods (id INTEGER PRIMARY KEY, file_path TEXT NOT NULL)`); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		cfg:   Config{DerivedDir: filepath.Join(dir, "derived")},
+		db:    db,
+		store: &localStorage{root: filepath.Join(dir, "storage")},
+	}
+	return s, dir
+}
+
+func TestThumbnailJob(t *testing.T) {
+	s, dir := newThumbTestServer(t)
+	video := filepath.Join(dir, "storage", "teams", "Alpha", "Ace", "match.mp4")
+	if err := os.MkdirAll(filepath.Dir(video), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(video, []byte("not really a video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.Exec(`INSERT INTO vods (id, file_path) VALUES (7, 'storage/teams/Alpha/Ace/match.mp4')`); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &fakeExtractor{duration: 125}
+	thumbs := newThumbnailer(s, fake)
+	payload, _ := json.Marshal(thumbnailJob{VodID: 7})
+	if err := thumbs.handle(context.Background(), payload); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(s.cfg.DerivedDir, "vods", "7")
+	if got := thumbs.dir(7); got != out {
+		t.Errorf("dir(7) = %q, want %q", got, out)
+	}
+	for _, src := range fake.srcs {
+		if src != video {
+			t.Errorf("extracted from %q, want %q", src, video)
+		}
+	}
+	// The poster comes first, then one frame every 10s: 0, 10, ..., 120.
+	if len(fake.frames) != 1+13 {
+		t.Fatalf("extracted %d frames, want 14: %v", len(fake.frames), fake.frames)
+	}
+	if fake.frames[0] != 12.5 {
+		t.Errorf("poster taken at %v, want 12.5", fake.frames[0])
+	}
+
+	poster := decodeTestJPEG(t, filepath.Join(out, "poster.jpg"))
+	if w := poster.Bounds().Dx(); w != posterWidth {
+		t.Errorf("poster is %dpx wide, want %d", w, posterWidth)
+	}
+	sprite := decodeTestJPEG(t, filepath.Join(out, "sprite.jpg"))
+	tileH := spriteTileWidth * 9 / 16
+	if got, want := sprite.Bounds().Size(), image.Pt(10*spriteTileWidth, 2*tileH); got != want {
+		t.Errorf("sprite is %v, want %v", got, want)
+	}
+	// Tile 12 (120s) sits at column 2 of the second row.
+	if c := color.GrayModel.Convert(sprite.At(2*spriteTileWidth+5, tileH+5)).(color.Gray); c.Y < 110 || c.Y > 130 {
+		t.Errorf("tile 12 has gray level %d, want about 120", c.Y)
+	}
+
+	vtt, err := os.ReadFile(filepath.Join(out, "sprite.vtt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cues := strings.Split(strings.TrimSpace(string(vtt)), "\n\n")
+	if cues[0] != "WEBVTT" || len(cues) != 14 {
+		t.Fatalf("sprite.vtt has %d blocks, want header and 13 cues:\n%s", len(cues), vtt)
+	}
+	if want := "00:00:00.000 --> 00:00:10.000\nsprite.jpg#xywh=0,0,160,90"; cues[1] != want {
+		t.Errorf("first cue = %q, want %q", cues[1], want)
+	}
+	if want := "00:02:00.000 --> 00:02:05.000\nsprite.jpg#xywh=320,90,160,90"; cues[13] != want {
+		t.Errorf("last cue = %q, want %q", cues[13], want)
+	}
+
+	leftovers, _ := filepath.Glob(filepath.Join(s.cfg.DerivedDir, "tmp-*"))
+	if len(leftovers) != 0 {
+		t.Errorf("temporary directories left behind: %v", leftovers)
+	}
+
+	// Previews newer than the video are kept; a newer video redoes them.
+	fake.frames = nil
+	if err := thumbs.handle(context.Background(), payload); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.frames) != 0 {
+		t.Errorf("regenerated up-to-date previews (%d frames)", len(fake.frames))
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(video, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := thumbs.handle(context.Background(), payload); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.frames) == 0 {
+		t.Error("kept previews older than the video")
+	}
+}
+
+func TestThumbnailJobMissingVod(t *testing.T) {
+	s, _ := newThumbTestServer(t)
+	thumbs := newThumbnailer(s, &fakeExtractor{duration: 60})
+	payload, _ := json.Marshal(thumbnailJob{VodID: 1})
+	var perm errPermanent
+	if err := thumbs.handle(context.Background(), payload); !errors.As(err, &perm) {
+		t.Errorf("missing VOD gave %v, want a permanent error", err)
+	}
+}
+
+func decodeTestJPEG(t *testing.T, path string) image.Image {
+	t.Helper()
+	img, err := decodeJPEG(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
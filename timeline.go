@@ -0,0 +1,292 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ----------------------- MATCH TIMELINE -----------------------
+
+// Every match has a clock. Match notes are stamped in match time, and each
+// VOD in the match has an offset: the match time at which its recording
+// starts. A moment T of the match is at T - offset in that VOD.
+//
+// Offsets are estimated from when each recording started, the MP4 mvhd
+// creation time when the file has one and recorded_at otherwise.
+// matches.clock_start pins match time zero the first time offsets are
+// estimated, so adding an earlier POV later doesn't move the notes already
+// written. Offsets set by hand are kept until they are reset.
+
+type syncVod struct {
+	id     int64
+	start  time.Time
+	offset sql.NullFloat64
+	manual bool
+}
+
+// syncMatch estimates the offsets of a match's VODs. resetManual drops
+// offsets set by hand and starts the clock again at the earliest recording.
+func (s *Server) syncMatch(matchID int64, resetManual bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var clock string
+	if err := tx.QueryRow(`SELECT COALESCE(clock_start, '') FROM matches WHERE id = ?`, matchID).Scan(&clock); err != nil {
+		return err
+	}
+	rows, err := tx.Query(`SELECT id, COALESCE(media_created_at, recorded_at, ''), match_offset, offset_source = 'manual'
+		FROM vods WHERE match_id = ? ORDER BY id`, matchID)
+	if err != nil {
+		return err
+	}
+	var vods []syncVod
+	for rows.Next() {
+		var v syncVod
+		var start string
+		var manual sql.NullBool
+		if err := rows.Scan(&v.id, &start, &v.offset, &manual); err != nil {
+			rows.Close()
+			return err
+		}
+		v.start, _ = time.Parse(time.DateTime, start)
+		v.manual = manual.Bool && !resetManual
+		vods = append(vods, v)
+	}
+	rows.Close()
+
+	origin, _ := time.Parse(time.DateTime, clock)
+	if resetManual {
+		origin = time.Time{}
+	}
+	if origin.IsZero() {
+		// Line up with the first hand-set offset if there is one, else start
+		// the clock at the earliest recording.
+		for _, v := range vods {
+			if v.manual && !v.start.IsZero() && v.offset.Valid {
+				origin = v.start.Add(-time.Duration(v.offset.Float64 * float64(time.Second)))
+				break
+			}
+		}
+		if origin.IsZero() {
+			for _, v := range vods {
+				if !v.start.IsZero() && (origin.IsZero() || v.start.Before(origin)) {
+					origin = v.start
+				}
+			}
+		}
+	}
+
+	for _, v := range vods {
+		if v.manual {
+			continue
+		}
+		var offset, source any
+		if !v.start.IsZero() {
+			offset, source = v.start.Sub(origin).Seconds(), "auto"
+		}
+		if _, err := tx.Exec(`UPDATE vods SET match_offset = ?, offset_source = ? WHERE id = ?`, offset, source, v.id); err != nil {
+			return err
+		}
+	}
+	var clockStart any
+	if !origin.IsZero() {
+		clockStart = origin.UTC().Format(time.DateTime)
+	}
+	if _, err := tx.Exec(`UPDATE matches SET clock_start = ? WHERE id = ?`, clockStart, matchID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// syncAfterAssign re-estimates offsets once VODs joined or left a match.
+// The assignment itself already succeeded, so a failure is only logged.
+func (s *Server) syncAfterAssign(matchID int64) {
+	if err := s.syncMatch(matchID, false); err != nil {
+		log.Println("Sync match error:", err)
+	}
+}
+
+// syncMatchHandler serves POST /api/matches/{id}/sync. With
+// {"reset_manual": true} it also drops hand-set offsets and restarts the
+// match clock, which shifts existing match notes along with it.
+func (s *Server) syncMatchHandler(w http.ResponseWriter, r *http.Request, m Match) {
+	var body struct {
+		ResetManual bool `json:"reset_manual"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "bad json", 400)
+			return
+		}
+	}
+	if err := s.syncMatch(m.ID, body.ResetManual); err != nil {
+		log.Println("Sync match error:", err)
+		http.Error(w, "db error", 500)
+		return
+	}
+	s.audit(r, "match.sync", "match", m.ID, nil, map[string]any{"reset_manual": body.ResetManual})
+	s.matchTimeline(w, r, m)
+}
+
+// setVodOffset serves PATCH /api/matches/{id}/vods/{vod_id} with
+// {"offset": 12.5}, in seconds of match time. {"offset": null} goes back
+// to the estimated offset.
+func (s *Server) setVodOffset(w http.ResponseWriter, r *http.Request, m Match, vodID int64) {
+	var body struct {
+		Offset json.RawMessage `json:"offset"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	if len(body.Offset) == 0 {
+		http.Error(w, "offset required", 400)
+		return
+	}
+	var before struct {
+		Offset *float64 `json:"offset"`
+		Source string   `json:"offset_source"`
+	}
+	err := s.db.QueryRow(`SELECT match_offset, COALESCE(offset_source, '') FROM vods WHERE id = ? AND match_id = ?`, vodID, m.ID).
+		Scan(&before.Offset, &before.Source)
+	if err == sql.ErrNoRows {
+		http.Error(w, "vod not in this match", 404)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+
+	var offset *float64
+	if err := json.Unmarshal(body.Offset, &offset); err != nil {
+		http.Error(w, "offset must be a number of seconds or null", 400)
+		return
+	}
+	if offset == nil {
+		_, err = s.db.Exec(`UPDATE vods SET offset_source = NULL WHERE id = ?`, vodID)
+		if err == nil {
+			err = s.syncMatch(m.ID, false)
+		}
+	} else {
+		_, err = s.db.Exec(`UPDATE vods SET match_offset = ?, offset_source = 'manual' WHERE id = ?`, *offset, vodID)
+	}
+	if err != nil {
+		log.Println("Set offset error:", err)
+		http.Error(w, "db error", 500)
+		return
+	}
+	s.audit(r, "match.offset", "match", m.ID, map[string]any{"vod_id": vodID, "offset": before.Offset, "offset_source": before.Source},
+		map[string]any{"vod_id": vodID, "offset": offset})
+	s.matchTimeline(w, r, m)
+}
+
+type timelinePOV struct {
+	VodID        int64    `json:"vod_id"`
+	Title        string   `json:"title"`
+	FilePath     string   `json:"file_path"`
+	PlayerID     int64    `json:"player_id"`
+	Player       string   `json:"player"`
+	Offset       float64  `json:"offset"`
+	OffsetSource string   `json:"offset_source"`
+	Duration     float64  `json:"duration,omitempty"`
+	StartedAt    string   `json:"started_at,omitempty"`
+	Position     *float64 `json:"position,omitempty"`
+}
+
+// at is where match time t falls in this POV, if it was recording then.
+// A POV of unknown duration is taken to run on forever.
+func (p timelinePOV) at(t float64) (float64, bool) {
+	pos := t - p.Offset
+	return pos, pos >= 0 && (p.Duration == 0 || pos <= p.Duration)
+}
+
+type timelineNote struct {
+	matchNote
+	// Positions maps vod_id to the note's place in each POV recording then.
+	Positions map[int64]float64 `json:"positions"`
+}
+
+// matchTimeline serves GET /api/matches/{id}/timeline: every POV with its
+// offset, and every match note with its position in each POV. ?t=95 adds
+// the position of match time 95 to each POV that was recording then.
+// POVs whose start is unknown have offset_source "none" and offset 0.
+func (s *Server) matchTimeline(w http.ResponseWriter, r *http.Request, m Match) {
+	var t *float64
+	if v := r.URL.Query().Get("t"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			http.Error(w, "bad t", 400)
+			return
+		}
+		t = &f
+	}
+	var clock string
+	if err := s.db.QueryRow(`SELECT COALESCE(clock_start, '') FROM matches WHERE id = ?`, m.ID).Scan(&clock); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+
+	rows, err := s.db.Query(`SELECT v.id, COALESCE(v.title, ''), v.file_path, v.player_id, p.name,
+		COALESCE(v.match_offset, 0), COALESCE(v.offset_source, 'none'), COALESCE(v.duration_seconds, 0),
+		COALESCE(v.media_created_at, v.recorded_at, '')
+		FROM vods v JOIN players p ON p.id = v.player_id
+		WHERE v.match_id = ? ORDER BY v.match_offset, v.id`, m.ID)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer rows.Close()
+	povs := []timelinePOV{}
+	var length float64
+	for rows.Next() {
+		var p timelinePOV
+		if err := rows.Scan(&p.VodID, &p.Title, &p.FilePath, &p.PlayerID, &p.Player,
+			&p.Offset, &p.OffsetSource, &p.Duration, &p.StartedAt); err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		if t != nil {
+			if pos, ok := p.at(*t); ok {
+				p.Position = &pos
+			}
+		}
+		length = max(length, p.Offset+p.Duration)
+		povs = append(povs, p)
+	}
+	rows.Close()
+
+	notes, err := s.matchNotes(m.ID)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	timeline := []timelineNote{}
+	for _, n := range notes {
+		tn := timelineNote{matchNote: n, Positions: map[int64]float64{}}
+		for _, p := range povs {
+			if pos, ok := p.at(n.TsSeconds); ok {
+				tn.Positions[p.VodID] = pos
+			}
+		}
+		timeline = append(timeline, tn)
+	}
+
+	resp := map[string]any{
+		"match":       m,
+		"clock_start": clock,
+		"length":      length,
+		"povs":        povs,
+		"notes":       timeline,
+	}
+	if t != nil {
+		resp["t"] = *t
+	}
+	writeJSON(w, 200, resp)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ----------------------- ACCESS TOKENS -----------------------
+
+// legacyKid names the key from jwtSecret. Tokens without a kid header were
+// signed with it.
+const legacyKid = "legacy"
+
+// accessClaims is everything an access token carries. sub is the user id.
+type accessClaims struct {
+	Role      string `json:"role"`
+	Username  string `json:"usr"`
+	SessionID int64  `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+// loadJWTKeys decodes jwtKeys (kid -> base64url secret) plus the legacy
+// jwtSecret and picks the key new tokens are signed with. Keys that are no
+// longer active still verify tokens until they are removed from config.
+func loadJWTKeys(cfg Config) (map[string][]byte, string, error) {
+	keys := make(map[string][]byte)
+	add := func(kid, secret string) error {
+		b, err := base64.RawURLEncoding.DecodeString(secret)
+		if err != nil {
+			return fmt.Errorf("jwt key %q: %w", kid, err)
+		}
+		if len(b) < 16 {
+			return fmt.Errorf("jwt key %q is too short", kid)
+		}
+		keys[kid] = b
+		return nil
+	}
+	for kid, secret := range cfg.JWTKeys {
+		if err := add(kid, secret); err != nil {
+			return nil, "", err
+		}
+	}
+	if _, ok := keys[legacyKid]; !ok && cfg.JWTSecret != "" {
+		if err := add(legacyKid, cfg.JWTSecret); err != nil {
+			return nil, "", err
+		}
+	}
+
+	active := cfg.JWTActiveKey
+	if active == "" {
+		switch {
+		case len(cfg.JWTKeys) == 1:
+			for kid := range cfg.JWTKeys {
+				active = kid
+			}
+		case len(cfg.JWTKeys) == 0:
+			active = legacyKid
+		default:
+			return nil, "", errors.New("jwtActiveKey must be set when jwtKeys has more than one key")
+		}
+	}
+	if _, ok := keys[active]; !ok {
+		return nil, "", fmt.Errorf("jwt signing key %q is not configured", active)
+	}
+	return keys, active, nil
+}
+
+func (s *Server) accessToken(u sessionUser, sid int64) (string, error) {
+	now := time.Now()
+	claims := accessClaims{
+		Role:      u.Role,
+		Username:  u.Username,
+		SessionID: sid,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.FormatInt(u.ID, 10),
+			Issuer:    s.cfg.JWTIssuer,
+			Audience:  jwt.ClaimStrings{s.cfg.JWTAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Duration(s.cfg.AccessTokenMinutes) * time.Minute)),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = s.jwtKid
+	return token.SignedString(s.jwtKeys[s.jwtKid])
+}
+
+// parseAccessToken verifies a token's signature, algorithm, issuer, audience
+// and expiry and returns its claims along with the user id from sub.
+func (s *Server) parseAccessToken(tokenStr string) (*accessClaims, int64, error) {
+	var claims accessClaims
+	_, err := jwt.ParseWithClaims(tokenStr, &claims, s.jwtKeyFor,
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(s.cfg.JWTIssuer),
+		jwt.WithAudience(s.cfg.JWTAudience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30*time.Second),
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || userID <= 0 {
+		return nil, 0, errors.New("token has an invalid subject")
+	}
+	if claims.SessionID <= 0 {
+		return nil, 0, errors.New("token has no session")
+	}
+	return &claims, userID, nil
+}
+
+func (s *Server) jwtKeyFor(t *jwt.Token) (any, error) {
+	kid, _ := t.Header["kid"].(string)
+	if kid == "" {
+		kid = legacyKid
+	}
+	key, ok := s.jwtKeys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// ----------------------- MFA TOKENS -----------------------
+
+// mfaAudience keeps the half-done-login tokens from being accepted as access
+// tokens, and the other way round.
+const mfaAudience = "vfe-mfa"
+
+const mfaTokenTTL = 5 * time.Minute
+
+// mfaToken proves a user got their password right, for loginMFA.
+func (s *Server) mfaToken(userID int64) (string, error) {
+	now := time.Now()
+	claims := jwt.RegisteredClaims{
+		Subject:   strconv.FormatInt(userID, 10),
+		Issuer:    s.cfg.JWTIssuer,
+		Audience:  jwt.ClaimStrings{mfaAudience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(mfaTokenTTL)),
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = s.jwtKid
+	return token.SignedString(s.jwtKeys[s.jwtKid])
+}
+
+func (s *Server) parseMFAToken(tokenStr string) (int64, error) {
+	var claims jwt.RegisteredClaims
+	_, err := jwt.ParseWithClaims(tokenStr, &claims, s.jwtKeyFor,
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(s.cfg.JWTIssuer),
+		jwt.WithAudience(mfaAudience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || userID <= 0 {
+		return 0, errors.New("token has an invalid subject")
+	}
+	return userID, nil
+}
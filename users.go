@@ -0,0 +1,399 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ----------------------- USER MANAGEMENT -----------------------
+
+type User struct {
+	ID                 int64  `json:"id"`
+	Username           string `json:"username"`
+	DisplayName        string `json:"display_name"`
+	Role               string `json:"role"`
+	Disabled           bool   `json:"disabled"`
+	DisabledAt         string `json:"disabled_at,omitempty"`
+	MustChangePassword bool   `json:"must_change_password"`
+	CreatedAt          string `json:"created_at"`
+}
+
+const userColumns = `id, username, COALESCE(display_name, ''), role, disabled_at IS NOT NULL,
+	COALESCE(disabled_at, ''), must_change_password, COALESCE(created_at, '')`
+
+func scanUser(row interface{ Scan(...any) error }) (User, error) {
+	var u User
+	err := row.Scan(&u.ID, &u.Username, &u.DisplayName, &u.Role, &u.Disabled, &u.DisabledAt, &u.MustChangePassword, &u.CreatedAt)
+	return u, err
+}
+
+// errLastAdmin keeps admins from locking everyone out of user management.
+var errLastAdmin = errors.New("can't remove the last active admin")
+
+// otherActiveAdmins counts enabled admins other than userID.
+func (s *Server) otherActiveAdmins(userID int64) (int, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM users WHERE role = 'admin' AND disabled_at IS NULL AND id != ?`, userID).Scan(&n)
+	return n, err
+}
+
+// users serves /api/admin/users (GET list, POST create) and
+// /api/admin/users/{id} (GET, PATCH, DELETE).
+func (s *Server) users(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/users"), "/")
+	if rest == "" {
+		switch r.Method {
+		case http.MethodGet:
+			s.listUsers(w, r)
+		case http.MethodPost:
+			s.createUser(w, r)
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+		return
+	}
+
+	id, err := strconv.ParseInt(rest, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		u, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+		if err == sql.ErrNoRows {
+			http.Error(w, "user not found", 404)
+			return
+		} else if err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		writeJSON(w, 200, u)
+	case http.MethodPatch:
+		s.updateUser(w, r, id)
+	case http.MethodDelete:
+		s.deleteUser(w, r, id)
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
+
+// listUsers supports ?q= (username or display name), ?role=, ?disabled=true|false
+// and limit/offset paging.
+func (s *Server) listUsers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit, offset := pageParams(r, 50, 500)
+
+	where := ` WHERE 1=1`
+	var args []any
+	if v := strings.TrimSpace(q.Get("q")); v != "" {
+		where += ` AND (username LIKE ? OR display_name LIKE ?)`
+		args = append(args, "%"+v+"%", "%"+v+"%")
+	}
+	if v := q.Get("role"); v != "" {
+		where += ` AND role = ?`
+		args = append(args, v)
+	}
+	switch q.Get("disabled") {
+	case "true":
+		where += ` AND disabled_at IS NOT NULL`
+	case "false":
+		where += ` AND disabled_at IS NULL`
+	}
+
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM users`+where, args...).Scan(&total); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	rows, err := s.db.Query(`SELECT `+userColumns+` FROM users`+where+` ORDER BY username LIMIT ? OFFSET ?`,
+		append(args, limit, offset)...)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		users = append(users, u)
+	}
+	writeJSON(w, 200, map[string]any{"users": users, "total": total, "limit": limit, "offset": offset})
+}
+
+// newUser is the body of POST /api/admin/users and /api/admin/add-user.
+type newUser struct {
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	Role        string `json:"role"`
+	DisplayName string `json:"display_name"`
+	Team        string `json:"team"` // optional, the team the user joins
+}
+
+// insertUser checks and adds a user, and their membership if a team is
+// given, trimming body's fields on the way. It answers failures itself and
+// reports whether the user was added.
+func (s *Server) insertUser(w http.ResponseWriter, r *http.Request, body *newUser) (int64, bool) {
+	body.Username = strings.TrimSpace(body.Username)
+	body.Role = strings.TrimSpace(body.Role)
+	body.Team = strings.TrimSpace(body.Team)
+	if body.Username == "" {
+		http.Error(w, "missing username", 400)
+		return 0, false
+	}
+	if !s.validRole(body.Role) {
+		http.Error(w, "invalid role", 400)
+		return 0, false
+	}
+	if !s.canGrant(r.Context(), body.Role) {
+		http.Error(w, "you can't grant that role", 403)
+		return 0, false
+	}
+	if err := checkNewPassword(body.Password); err != nil {
+		http.Error(w, err.Error(), 400)
+		return 0, false
+	}
+	var teamID int64
+	if body.Team != "" {
+		err := s.db.QueryRow(`SELECT id FROM teams WHERE name = ?`, body.Team).Scan(&teamID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "team not found", 404)
+			return 0, false
+		} else if err != nil {
+			http.Error(w, "db error", 500)
+			return 0, false
+		}
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(body.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "could not hash password", 500)
+		return 0, false
+	}
+	var displayName any
+	if dn := strings.TrimSpace(body.DisplayName); dn != "" {
+		displayName = dn
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return 0, false
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`INSERT INTO users (username, password_hash, role, display_name) VALUES (?, ?, ?, ?)`,
+		body.Username, hash, body.Role, displayName)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			http.Error(w, "username already taken", 409)
+			return 0, false
+		}
+		http.Error(w, "db error", 500)
+		return 0, false
+	}
+	id, _ := res.LastInsertId()
+	if teamID != 0 {
+		if _, err := tx.Exec(`INSERT INTO memberships (user_id, team_id) VALUES (?, ?)`, id, teamID); err != nil {
+			http.Error(w, "db error", 500)
+			return 0, false
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "commit error", 500)
+		return 0, false
+	}
+	return id, true
+}
+
+func (s *Server) createUser(w http.ResponseWriter, r *http.Request) {
+	var body newUser
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	id, ok := s.insertUser(w, r, &body)
+	if !ok {
+		return
+	}
+	u, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	s.audit(r, "user.create", "user", id, nil, u)
+	writeJSON(w, 201, u)
+}
+
+// updateUser changes role, display_name (null or "" clears it) or disabled.
+// Disabling signs the user out everywhere; their notes stay.
+func (s *Server) updateUser(w http.ResponseWriter, r *http.Request, id int64) {
+	var body struct {
+		Role        *string         `json:"role"`
+		DisplayName json.RawMessage `json:"display_name"`
+		Disabled    *bool           `json:"disabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+
+	current, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		http.Error(w, "user not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if !s.canGrant(r.Context(), current.Role) {
+		http.Error(w, "you can't manage that user", 403)
+		return
+	}
+
+	sets, args := []string{}, []any{}
+	if body.Role != nil {
+		if !s.validRole(*body.Role) {
+			http.Error(w, "invalid role", 400)
+			return
+		}
+		if !s.canGrant(r.Context(), *body.Role) {
+			http.Error(w, "you can't grant that role", 403)
+			return
+		}
+		sets, args = append(sets, "role = ?"), append(args, *body.Role)
+	}
+	if body.DisplayName != nil {
+		var dn *string
+		if err := json.Unmarshal(body.DisplayName, &dn); err != nil {
+			http.Error(w, "display_name must be a string or null", 400)
+			return
+		}
+		var v any
+		if dn != nil && strings.TrimSpace(*dn) != "" {
+			v = strings.TrimSpace(*dn)
+		}
+		sets, args = append(sets, "display_name = ?"), append(args, v)
+	}
+	if body.Disabled != nil {
+		if *body.Disabled {
+			sets = append(sets, "disabled_at = COALESCE(disabled_at, CURRENT_TIMESTAMP)")
+		} else {
+			sets = append(sets, "disabled_at = NULL")
+		}
+	}
+	if len(sets) == 0 {
+		http.Error(w, "nothing to update", 400)
+		return
+	}
+
+	losesAdmin := current.Role == "admin" && !current.Disabled &&
+		((body.Role != nil && *body.Role != "admin") || (body.Disabled != nil && *body.Disabled))
+	if losesAdmin {
+		n, err := s.otherActiveAdmins(id)
+		if err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		if n == 0 {
+			http.Error(w, errLastAdmin.Error(), 409)
+			return
+		}
+	}
+
+	if _, err := s.db.Exec(`UPDATE users SET `+strings.Join(sets, ", ")+` WHERE id = ?`, append(args, id)...); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if body.Disabled != nil && *body.Disabled {
+		s.revokeSessions(id, 0)
+		fmt.Println("🚫 Disabled user:", current.Username)
+	}
+
+	u, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	s.audit(r, "user.update", "user", id, current, u)
+	writeJSON(w, 200, u)
+}
+
+// deleteUser removes a user with their sessions, memberships and notes.
+// Disable the account instead to keep their notes.
+func (s *Server) deleteUser(w http.ResponseWriter, r *http.Request, id int64) {
+	if self, _ := userFrom(r.Context()); self == id {
+		http.Error(w, "you can't delete yourself", 409)
+		return
+	}
+	u, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		http.Error(w, "user not found", 404)
+		return
+	} else if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if !s.canGrant(r.Context(), u.Role) {
+		http.Error(w, "you can't manage that user", 403)
+		return
+	}
+	if u.Role == "admin" {
+		n, err := s.otherActiveAdmins(id)
+		if err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		if n == 0 {
+			http.Error(w, errLastAdmin.Error(), 409)
+			return
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`DELETE FROM notes WHERE user_id = ?`, id)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	notes, _ := res.RowsAffected()
+	for _, stmt := range []string{
+		`DELETE FROM memberships WHERE user_id = ?`,
+		`DELETE FROM sessions WHERE user_id = ?`,
+		`DELETE FROM password_resets WHERE user_id = ?`,
+		`DELETE FROM mfa_recovery_codes WHERE user_id = ?`,
+		`DELETE FROM api_keys WHERE user_id = ?`,
+		`DELETE FROM user_identities WHERE user_id = ?`,
+		`DELETE FROM sso_codes WHERE user_id = ?`,
+		`DELETE FROM note_reads WHERE user_id = ?`,
+		`DELETE FROM match_notes WHERE user_id = ?`,
+		`UPDATE players SET user_id = NULL WHERE user_id = ?`,
+		`DELETE FROM users WHERE id = ?`,
+	} {
+		if _, err := tx.Exec(stmt, id); err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "commit error", 500)
+		return
+	}
+	s.audit(r, "user.delete", "user", id, u, map[string]any{"notes_deleted": notes})
+	writeJSON(w, 200, map[string]any{"ok": true, "deleted": id, "notes_deleted": notes})
+}
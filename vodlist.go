@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------------------- VOD LISTING -----------------------
+
+// vodSorts maps the sort names /api/list-vods accepts to the expression
+// rows are ordered by. Ties are broken by id in the same direction.
+var vodSorts = map[string]string{
+	"created":  "v.id",
+	"recorded": "COALESCE(v.recorded_at, v.created_at, '')",
+	"title":    "lower(COALESCE(v.title, ''))",
+	"size":     "COALESCE(v.size_bytes, 0)",
+	"duration": "COALESCE(v.duration_seconds, 0)",
+	"notes":    "(SELECT COUNT(*) FROM notes n WHERE n.vod_id = v.id)",
+}
+
+// vodCursor marks where a page ended: the sort value and id of its last
+// row, and the sort it was made for.
+type vodCursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d"`
+	Value any    `json:"v"`
+	ID    int64  `json:"id"`
+}
+
+func (c vodCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeVodCursor(v string) (vodCursor, error) {
+	var c vodCursor
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	if err == nil {
+		err = json.Unmarshal(b, &c)
+	}
+	if err != nil {
+		return c, fmt.Errorf("bad cursor")
+	}
+	return c, nil
+}
+
+// vodFilter turns the query string of /api/list-vods into a WHERE clause.
+func (s *Server) vodFilter(r *http.Request) (string, []any, error) {
+	q := r.URL.Query()
+	where, args := []string{"1 = 1"}, []any{}
+	if !s.can(r.Context(), "teams:all") {
+		userID, _ := userFrom(r.Context())
+		scope, scopeArgs := teamScope("COALESCE(v.team_id, p.team_id)", userID)
+		where, args = append(where, scope), append(args, scopeArgs...)
+	}
+	for param, column := range map[string]string{"team_id": "COALESCE(v.team_id, p.team_id)", "player_id": "v.player_id", "match_id": "v.match_id"} {
+		v := q.Get(param)
+		if v == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("bad %s", param)
+		}
+		where, args = append(where, column+" = ?"), append(args, id)
+	}
+	for _, param := range []string{"game", "map", "opponent"} {
+		if v := q.Get(param); v != "" {
+			where, args = append(where, "v."+param+" = ? COLLATE NOCASE"), append(args, v)
+		}
+	}
+	if v := q.Get("tag"); v != "" {
+		where, args = append(where, "EXISTS (SELECT 1 FROM vod_tags vt WHERE vt.vod_id = v.id AND vt.tag = ?)"), append(args, strings.ToLower(v))
+	}
+	for param, op := range map[string]string{"from": ">=", "to": "<="} {
+		v := q.Get(param)
+		if v == "" {
+			continue
+		}
+		t, err := parseTime(v)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s: %v", param, err)
+		}
+		// A bare date for "to" means the whole of that day.
+		if param == "to" && len(v) == len(time.DateOnly) {
+			t = t.Add(24*time.Hour - time.Second)
+		}
+		where, args = append(where, "COALESCE(v.recorded_at, v.created_at) "+op+" ?"), append(args, t.UTC().Format(time.DateTime))
+	}
+	switch q.Get("has_notes") {
+	case "":
+	case "true":
+		where = append(where, "EXISTS (SELECT 1 FROM notes n WHERE n.vod_id = v.id)")
+	case "false":
+		where = append(where, "NOT EXISTS (SELECT 1 FROM notes n WHERE n.vod_id = v.id)")
+	default:
+		return "", nil, fmt.Errorf("has_notes must be true or false")
+	}
+	switch q.Get("unreviewed") {
+	case "":
+	case "true":
+		where = append(where, "NOT EXISTS (SELECT 1 FROM notes n WHERE n.vod_id = v.id AND n.user_id != COALESCE(p.user_id, 0))")
+	case "false":
+		where = append(where, "EXISTS (SELECT 1 FROM notes n WHERE n.vod_id = v.id AND n.user_id != COALESCE(p.user_id, 0))")
+	default:
+		return "", nil, fmt.Errorf("unreviewed must be true or false")
+	}
+	switch q.Get("archived") {
+	case "":
+	case "true":
+		where = append(where, "v.archived_at IS NOT NULL")
+	case "false":
+		where = append(where, "v.archived_at IS NULL")
+	default:
+		return "", nil, fmt.Errorf("archived must be true or false")
+	}
+	return strings.Join(where, " AND "), args, nil
+}
+
+// listVods serves GET /api/list-vods: the VODs of the caller's teams, or
+// of every team with teams:all, a page at a time.
+//
+// Filters: team_id, player_id, match_id, game, map, opponent, tag, from and
+// to (on the recording date, else when the VOD was added), has_notes,
+// unreviewed (no notes yet from anyone but the player's own account) and
+// archived. sort is one of created (default), recorded, title, size,
+// duration or notes, and order is desc (default) or asc. Pass next_cursor
+// back as ?cursor= with the same sort for the next page; it is empty on
+// the last one.
+func (s *Server) listVods(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", 405)
+		return
+	}
+	q := r.URL.Query()
+	sort := q.Get("sort")
+	if sort == "" {
+		sort = "created"
+	}
+	key, ok := vodSorts[sort]
+	if !ok {
+		http.Error(w, "sort must be one of created, recorded, title, size, duration, notes", 400)
+		return
+	}
+	desc := true
+	switch q.Get("order") {
+	case "", "desc":
+	case "asc":
+		desc = false
+	default:
+		http.Error(w, "order must be asc or desc", 400)
+		return
+	}
+	where, args, err := s.vodFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	limit, _ := pageParams(r, 100, 500)
+
+	dir, cmp := "DESC", "<"
+	if !desc {
+		dir, cmp = "ASC", ">"
+	}
+	if v := q.Get("cursor"); v != "" {
+		c, err := decodeVodCursor(v)
+		if err != nil || c.Sort != sort || c.Desc != desc {
+			http.Error(w, "bad cursor", 400)
+			return
+		}
+		where += fmt.Sprintf(" AND (%[1]s %[2]s ? OR (%[1]s = ? AND v.id %[2]s ?))", key, cmp)
+		args = append(args, c.Value, c.Value, c.ID)
+	}
+
+	rows, err := s.db.Query(`SELECT `+vodColumns+`, `+key+vodFrom+` WHERE `+where+
+		fmt.Sprintf(` ORDER BY %s %s, v.id %s LIMIT ?`, key, dir, dir), append(args, limit+1)...)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer rows.Close()
+	// One row more than asked for tells whether there is a next page.
+	vods, keys := []VodInfo{}, []any{}
+	for rows.Next() {
+		var key any
+		v, err := scanVodInfo(sortKeyScanner{rows, &key})
+		if err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		vods, keys = append(vods, v), append(keys, key)
+	}
+	rows.Close()
+	more := len(vods) > limit
+	if more {
+		vods = vods[:limit]
+	}
+	byID := map[int64]int{}
+	for i, v := range vods {
+		byID[v.ID] = i
+	}
+
+	if len(vods) > 0 {
+		ids, marks := make([]any, 0, len(vods)), make([]string, 0, len(vods))
+		for _, v := range vods {
+			ids, marks = append(ids, v.ID), append(marks, "?")
+		}
+		tags, err := s.db.Query(`SELECT vod_id, tag FROM vod_tags WHERE vod_id IN (`+strings.Join(marks, ", ")+`) ORDER BY tag`, ids...)
+		if err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		defer tags.Close()
+		for tags.Next() {
+			var id int64
+			var tag string
+			if err := tags.Scan(&id, &tag); err != nil {
+				http.Error(w, "db error", 500)
+				return
+			}
+			vods[byID[id]].Tags = append(vods[byID[id]].Tags, tag)
+		}
+	}
+
+	next := ""
+	if more {
+		next = vodCursor{Sort: sort, Desc: desc, Value: keys[limit-1], ID: vods[limit-1].ID}.encode()
+	}
+	writeJSON(w, 200, map[string]any{"vods": vods, "next_cursor": next, "limit": limit})
+}
+
+// sortKeyScanner lets scanVodInfo read a row that has the sort key as an
+// extra last column, which it stores in key.
+type sortKeyScanner struct {
+	row interface{ Scan(...any) error }
+	key *any
+}
+
+func (s sortKeyScanner) Scan(dest ...any) error {
+	return s.row.Scan(append(dest, s.key)...)
+}
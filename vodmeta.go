@@ -0,0 +1,370 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------------------- VOD METADATA -----------------------
+
+// A scan titles a VOD after its file. Coaches can then give it a real title
+// and a description, and record the game, map, patch and opponent, when it
+// was recorded and any number of tags. Tags live in vod_tags, which
+// retention rules already match on.
+
+const (
+	maxVodTitle       = 120
+	maxVodDescription = 2000
+	maxVodField       = 60
+	maxVodTag         = 32
+	maxVodTags        = 20
+)
+
+type VodInfo struct {
+	ID          int64    `json:"id"`
+	FilePath    string   `json:"file_path"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Game        string   `json:"game"`
+	Map         string   `json:"map"`
+	Patch       string   `json:"patch"`
+	Opponent    string   `json:"opponent"`
+	RecordedAt  string   `json:"recorded_at"`
+	Tags        []string `json:"tags"`
+	TeamID      int64    `json:"team_id"`
+	TeamName    string   `json:"team_name"`
+	PlayerID    int64    `json:"player_id"`
+	PlayerName  string   `json:"player_name"`
+	MatchID     int64    `json:"match_id,omitempty"`
+	SizeBytes   int64    `json:"size_bytes"`
+	Duration    float64  `json:"duration_seconds"`
+	NoteCount   int      `json:"note_count"`
+	Archived    bool     `json:"archived"`
+	CreatedAt   string   `json:"created_at"`
+}
+
+const vodColumns = `v.id, v.file_path, COALESCE(v.title, ''), COALESCE(v.description, ''), COALESCE(v.game, ''),
+	COALESCE(v.map, ''), COALESCE(v.patch, ''), COALESCE(v.opponent, ''), COALESCE(v.recorded_at, ''),
+	COALESCE(v.team_id, p.team_id), COALESCE(t.name, ''), v.player_id, p.name, COALESCE(v.match_id, 0),
+	COALESCE(v.size_bytes, 0), COALESCE(v.duration_seconds, 0),
+	(SELECT COUNT(*) FROM notes n WHERE n.vod_id = v.id), v.archived_at IS NOT NULL, COALESCE(v.created_at, '')`
+
+// vodFrom joins what vodColumns needs.
+const vodFrom = ` FROM vods v JOIN players p ON p.id = v.player_id
+	LEFT JOIN teams t ON t.id = COALESCE(v.team_id, p.team_id)`
+
+func scanVodInfo(row interface{ Scan(...any) error }) (VodInfo, error) {
+	var v VodInfo
+	err := row.Scan(&v.ID, &v.FilePath, &v.Title, &v.Description, &v.Game, &v.Map, &v.Patch, &v.Opponent,
+		&v.RecordedAt, &v.TeamID, &v.TeamName, &v.PlayerID, &v.PlayerName, &v.MatchID, &v.SizeBytes, &v.Duration,
+		&v.NoteCount, &v.Archived, &v.CreatedAt)
+	v.Tags = []string{}
+	return v, err
+}
+
+func (s *Server) vodInfo(id int64) (VodInfo, error) {
+	v, err := scanVodInfo(s.db.QueryRow(`SELECT `+vodColumns+vodFrom+` WHERE v.id = ?`, id))
+	if err != nil {
+		return v, err
+	}
+	rows, err := s.db.Query(`SELECT tag FROM vod_tags WHERE vod_id = ? ORDER BY tag`, id)
+	if err != nil {
+		return v, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return v, err
+		}
+		v.Tags = append(v.Tags, tag)
+	}
+	return v, rows.Err()
+}
+
+// vodPatch is the body of PATCH /api/vods/{id}. Fields left out stay as
+// they are; an empty string clears one. tags replaces the whole set.
+type vodPatch struct {
+	Title       *string   `json:"title"`
+	Description *string   `json:"description"`
+	Game        *string   `json:"game"`
+	Map         *string   `json:"map"`
+	Patch       *string   `json:"patch"`
+	Opponent    *string   `json:"opponent"`
+	RecordedAt  *string   `json:"recorded_at"`
+	Tags        *[]string `json:"tags"`
+}
+
+func (b *vodPatch) validate() error {
+	limits := map[string]int{"title": maxVodTitle, "description": maxVodDescription}
+	for field, v := range b.fields() {
+		if v == nil {
+			continue
+		}
+		*v = strings.TrimSpace(*v)
+		limit, ok := limits[field]
+		if !ok {
+			limit = maxVodField
+		}
+		if len(*v) > limit {
+			return fmt.Errorf("%s is too long (max %d characters)", field, limit)
+		}
+	}
+	if b.Title != nil && *b.Title == "" {
+		return fmt.Errorf("title can't be empty")
+	}
+	if b.RecordedAt != nil && *b.RecordedAt != "" {
+		t, err := parseTime(strings.TrimSpace(*b.RecordedAt))
+		if err != nil {
+			return fmt.Errorf("recorded_at: %v", err)
+		}
+		*b.RecordedAt = t.UTC().Format(time.DateTime)
+	}
+	if b.Tags != nil {
+		tags := []string{}
+		for _, tag := range *b.Tags {
+			tag = strings.ToLower(strings.TrimSpace(tag))
+			if tag == "" || slices.Contains(tags, tag) {
+				continue
+			}
+			if len(tag) > maxVodTag || strings.Contains(tag, ",") {
+				return fmt.Errorf("tags are limited to %d characters and can't contain commas", maxVodTag)
+			}
+			tags = append(tags, tag)
+		}
+		if len(tags) > maxVodTags {
+			return fmt.Errorf("at most %d tags", maxVodTags)
+		}
+		*b.Tags = tags
+	}
+	return nil
+}
+
+// fields maps the text columns to their values, not counting recorded_at.
+func (b *vodPatch) fields() map[string]*string {
+	return map[string]*string{"title": b.Title, "description": b.Description, "game": b.Game,
+		"map": b.Map, "patch": b.Patch, "opponent": b.Opponent}
+}
+
+func (b *vodPatch) apply(tx *sql.Tx, id int64) error {
+	sets, args := []string{}, []any{}
+	for column, v := range b.fields() {
+		if v != nil {
+			sets, args = append(sets, column+" = ?"), append(args, nullString(*v))
+		}
+	}
+	if b.RecordedAt != nil {
+		sets, args = append(sets, "recorded_at = ?"), append(args, nullString(*b.RecordedAt))
+	}
+	if len(sets) > 0 {
+		if _, err := tx.Exec(`UPDATE vods SET `+strings.Join(sets, ", ")+` WHERE id = ?`, append(args, id)...); err != nil {
+			return err
+		}
+	}
+	if b.Tags == nil {
+		return nil
+	}
+	if _, err := tx.Exec(`DELETE FROM vod_tags WHERE vod_id = ?`, id); err != nil {
+		return err
+	}
+	for _, tag := range *b.Tags {
+		if _, err := tx.Exec(`INSERT INTO vod_tags (vod_id, tag) VALUES (?, ?)`, id, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// vodDetail serves GET and PATCH /api/vods/{id}. Reading needs vods:read
+// on the VOD's team and editing needs vods:upload there, so whoever may
+// add a team's VODs may also describe them.
+func (s *Server) vodDetail(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/vods"), "/"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	perm := "vods:read"
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		perm = "vods:upload"
+	default:
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	if !s.requireVod(w, r, perm, id) {
+		return
+	}
+	before, err := s.vodInfo(id)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(w, 200, before)
+		return
+	}
+
+	var body vodPatch
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	if err := body.validate(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer tx.Rollback()
+	if err := body.apply(tx, id); err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "commit error", 500)
+		return
+	}
+	// A new recording time moves the VOD on its match's clock.
+	if body.RecordedAt != nil && before.MatchID != 0 {
+		s.syncAfterAssign(before.MatchID)
+	}
+
+	after, err := s.vodInfo(id)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	s.audit(r, "vod.update", "vod", id, before, after)
+	writeJSON(w, 200, map[string]any{"ok": true, "vod": after})
+}
+
+// ----------------------- FILE NAME PATTERNS -----------------------
+
+// NamePattern fills in metadata for new VODs whose file name matches
+// Pattern, a regular expression over the file name. Its named groups title,
+// game, map, patch, opponent, date (2026-10-01, 2026.10.01 or 20261001),
+// time (20-15-03, 20:15 or 2015) and tags (split on "+" or ",") set those
+// fields; Game and Tags apply to every match. For example
+//
+//	{"pattern": "^(?P<date>\\d{4}-\\d{2}-\\d{2})_(?P<map>[^_]+)_vs_(?P<opponent>[^.]+)\\.mp4$", "game": "Valorant"}
+type NamePattern struct {
+	Pattern string   `json:"pattern"`
+	Game    string   `json:"game,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+}
+
+type namePattern struct {
+	NamePattern
+	re *regexp.Regexp
+}
+
+func compileNamePatterns(patterns []NamePattern) ([]namePattern, error) {
+	var out []namePattern
+	for i, p := range patterns {
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("vodNamePatterns %d: %v", i+1, err)
+		}
+		out = append(out, namePattern{p, re})
+	}
+	return out, nil
+}
+
+// parseVodName applies the first pattern matching filename, with its date
+// and time read in the server's time zone. It reports false if none match.
+func (s *Server) parseVodName(filename string) (vodPatch, bool) {
+	var meta vodPatch
+	for _, p := range s.namePatterns {
+		m := p.re.FindStringSubmatch(filename)
+		if m == nil {
+			continue
+		}
+		group := func(name string) string {
+			if i := p.re.SubexpIndex(name); i > 0 {
+				return strings.ReplaceAll(strings.TrimSpace(m[i]), "_", " ")
+			}
+			return ""
+		}
+		set := func(dst **string, v string) {
+			if v != "" {
+				*dst = &v
+			}
+		}
+		set(&meta.Title, group("title"))
+		set(&meta.Game, p.Game)
+		set(&meta.Game, group("game"))
+		set(&meta.Map, group("map"))
+		set(&meta.Patch, group("patch"))
+		set(&meta.Opponent, group("opponent"))
+		if at := nameTime(group("date"), group("time")); !at.IsZero() {
+			set(&meta.RecordedAt, at.UTC().Format(time.DateTime))
+		}
+		tags := slices.Clone(p.Tags)
+		for _, tag := range strings.FieldsFunc(group("tags"), func(r rune) bool { return r == '+' || r == ',' }) {
+			tags = append(tags, tag)
+		}
+		if len(tags) > 0 {
+			meta.Tags = &tags
+		}
+		return meta, true
+	}
+	return meta, false
+}
+
+var nonDigits = regexp.MustCompile(`\D`)
+
+// nameTime reads a date and an optional time of day from a file name.
+func nameTime(date, clock string) time.Time {
+	date, clock = nonDigits.ReplaceAllString(date, ""), nonDigits.ReplaceAllString(clock, "")
+	if len(date) != 8 {
+		return time.Time{}
+	}
+	for len(clock) < 6 {
+		clock += "0"
+	}
+	t, err := time.ParseInLocation("20060102150405", date+clock[:6], time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// applyVodName fills in a new VOD's metadata from its file name. A file
+// name the patterns don't describe is left alone, and bad values are
+// logged and skipped rather than failing the scan or upload.
+func (s *Server) applyVodName(vodID int64, filename string) {
+	meta, ok := s.parseVodName(filename)
+	if !ok {
+		return
+	}
+	if err := meta.validate(); err != nil {
+		log.Printf("File name metadata for %s: %v", filename, err)
+		return
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Println("File name metadata error:", err)
+		return
+	}
+	defer tx.Rollback()
+	if err := meta.apply(tx, vodID); err != nil {
+		log.Println("File name metadata error:", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("File name metadata error:", err)
+	}
+}